@@ -0,0 +1,163 @@
+package cform
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	cf "github.com/aws/aws-sdk-go/service/cloudformation"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// RequiredCapability is a capability which must be acknowledged to create or
+// update a stack using the template.
+type RequiredCapability struct {
+	Name string
+	// Reasons why the capability is required, e.g. the resources which
+	// require it
+	Reasons []string
+}
+
+func (c RequiredCapability) String() string {
+	return fmt.Sprintf("%s (%s)", c.Name, strings.Join(c.Reasons, ", "))
+}
+
+// iamResourceNameProperties maps the IAM resource types which require the
+// `CAPABILITY_IAM` capability to the property which gives them a custom name,
+// which requires the `CAPABILITY_NAMED_IAM` capability instead.
+var iamResourceNameProperties = map[string]string{
+	"AWS::IAM::AccessKey":           "",
+	"AWS::IAM::Group":               "GroupName",
+	"AWS::IAM::InstanceProfile":     "InstanceProfileName",
+	"AWS::IAM::ManagedPolicy":       "ManagedPolicyName",
+	"AWS::IAM::Policy":              "",
+	"AWS::IAM::Role":                "RoleName",
+	"AWS::IAM::User":                "UserName",
+	"AWS::IAM::UserToGroupAddition": "",
+}
+
+// Capabilities returns the capabilities required by the template sorted by
+// their names.
+//
+// IAM resources require `CAPABILITY_IAM`, or `CAPABILITY_NAMED_IAM` if any of
+// them has a custom name. Macros, i.e. the `Transform` section and the
+// `Fn::Transform` function, and nested stacks, which may use macros, require
+// `CAPABILITY_AUTO_EXPAND`.
+func (t *Template) Capabilities() []RequiredCapability {
+	reasons := make(map[string][]string)
+	add := func(name, reason string) {
+		reasons[name] = append(reasons[name], reason)
+	}
+
+	if s, ok := t.sections["Transform"]; ok {
+		for _, m := range s.value.Content {
+			add(cf.CapabilityCapabilityAutoExpand, "Transform "+m.Value)
+		}
+	}
+
+	for _, k := range t.sectionNames() {
+		s := t.sections[k]
+		if s.entries == nil {
+			if s.value != nil && hasKey(s.value, "Fn::Transform") {
+				add(cf.CapabilityCapabilityAutoExpand, "Fn::Transform in "+k)
+			}
+			continue
+		}
+
+		for _, kk := range s.keys {
+			e := s.entries[kk]
+			if hasKey(e.value, "Fn::Transform") {
+				add(cf.CapabilityCapabilityAutoExpand, fmt.Sprintf("Fn::Transform in %s.%s", k, kk))
+			}
+			if k != "Resources" {
+				continue
+			}
+
+			typ := mappingValue(e.value, "Type")
+			if typ == nil {
+				continue
+			}
+			if typ.Value == "AWS::CloudFormation::Stack" {
+				add(cf.CapabilityCapabilityAutoExpand, "nested stack "+kk)
+			}
+			if nameProp, ok := iamResourceNameProperties[typ.Value]; ok {
+				if props := mappingValue(e.value, "Properties"); nameProp != "" && props != nil && mappingValue(props, nameProp) != nil {
+					add(cf.CapabilityCapabilityNamedIam, fmt.Sprintf("%s (%s with %s)", kk, typ.Value, nameProp))
+				} else {
+					add(cf.CapabilityCapabilityIam, fmt.Sprintf("%s (%s)", kk, typ.Value))
+				}
+			}
+		}
+	}
+
+	// Named IAM resources are acknowledged along with the unnamed resources
+	if named, ok := reasons[cf.CapabilityCapabilityNamedIam]; ok {
+		reasons[cf.CapabilityCapabilityNamedIam] = append(named, reasons[cf.CapabilityCapabilityIam]...)
+		delete(reasons, cf.CapabilityCapabilityIam)
+	}
+
+	var caps []RequiredCapability
+	for name, r := range reasons {
+		caps = append(caps, RequiredCapability{Name: name, Reasons: r})
+	}
+	sort.Slice(caps, func(i, j int) bool { return caps[i].Name < caps[j].Name })
+	return caps
+}
+
+// ResolveCapabilities returns the capabilities acknowledged for the stack.
+//
+// If the stack config does not list any capabilities, the capabilities
+// required by the template are acknowledged. Otherwise the stack config lists
+// the only capabilities which can be acknowledged and it is an error if the
+// template requires any other capability.
+func (c *StackConfig) ResolveCapabilities(required []RequiredCapability) ([]string, error) {
+	if c.Capabilities == nil {
+		var names []string
+		for _, r := range required {
+			names = append(names, r.Name)
+		}
+		return names, nil
+	}
+
+	var denied []string
+	for _, r := range required {
+		if indexOf(c.Capabilities, r.Name) >= 0 {
+			continue
+		}
+		if r.Name == cf.CapabilityCapabilityIam && indexOf(c.Capabilities, cf.CapabilityCapabilityNamedIam) >= 0 {
+			continue
+		}
+		denied = append(denied, r.String())
+	}
+	if len(denied) > 0 {
+		return nil, fmt.Errorf("Capabilities required by the template but not allowed by the stack config: %s", strings.Join(denied, "; "))
+	}
+	return c.Capabilities, nil
+}
+
+// mappingValue returns the value of the key in the dictionary node or nil if
+// the node is not a dictionary or does not have the key.
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// hasKey checks if any dictionary in the node tree has the key.
+func hasKey(n *yaml.Node, key string) bool {
+	if mappingValue(n, key) != nil {
+		return true
+	}
+	for _, c := range n.Content {
+		if hasKey(c, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package cform
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func capabilitiesTemplate(t *testing.T, sources ...string) *Template {
+	tmpl := NewTemplate(MergeOptions{})
+	for i, s := range sources {
+		if err := tmpl.Add(fmt.Sprintf("yaml-%d", i), []byte(format(s))); err != nil {
+			t.Fatalf("Failed to create template: %s", err)
+		}
+	}
+	return tmpl
+}
+
+func TestTemplateCapabilities(t *testing.T) {
+	var d1 = `
+	Resources:
+		Role:
+			Type: AWS::IAM::Role
+		Bucket:
+			Type: AWS::S3::Bucket
+	`
+
+	var d2 = `
+	Resources:
+		AdminRole:
+			Type: AWS::IAM::Role
+			Properties:
+				RoleName: admin
+		Network:
+			Type: AWS::CloudFormation::Stack
+	`
+
+	var d3 = `
+	Transform: AWS::Serverless-2016-10-31
+	Resources:
+		Function:
+			Type: AWS::Serverless::Function
+			Properties:
+				Environment:
+					Fn::Transform:
+						Name: Env
+	`
+
+	tests := []struct {
+		sources  []string
+		expected []string
+	}{
+		{nil, nil},
+		{[]string{d1}, []string{"CAPABILITY_IAM (Role (AWS::IAM::Role))"}},
+		{[]string{d1, d2}, []string{
+			"CAPABILITY_AUTO_EXPAND (nested stack Network)",
+			"CAPABILITY_NAMED_IAM (AdminRole (AWS::IAM::Role with RoleName), Role (AWS::IAM::Role))",
+		}},
+		{[]string{d3}, []string{
+			"CAPABILITY_AUTO_EXPAND (Transform AWS::Serverless-2016-10-31, Fn::Transform in Resources.Function)",
+		}},
+	}
+
+	for _, test := range tests {
+		var found []string
+		for _, c := range capabilitiesTemplate(t, test.sources...).Capabilities() {
+			found = append(found, c.String())
+		}
+		if !reflect.DeepEqual(test.expected, found) {
+			t.Errorf("Expected (%s), Found (%s)", test.expected, found)
+		}
+	}
+}
+
+func TestResolveCapabilities(t *testing.T) {
+	required := []RequiredCapability{
+		{Name: "CAPABILITY_AUTO_EXPAND", Reasons: []string{"nested stack Network"}},
+		{Name: "CAPABILITY_IAM", Reasons: []string{"Role (AWS::IAM::Role)"}},
+	}
+
+	tests := []struct {
+		allowed  []string
+		expected []string
+		err      string
+	}{
+		{nil, []string{"CAPABILITY_AUTO_EXPAND", "CAPABILITY_IAM"}, ""},
+		{[]string{"CAPABILITY_AUTO_EXPAND", "CAPABILITY_NAMED_IAM"}, []string{"CAPABILITY_AUTO_EXPAND", "CAPABILITY_NAMED_IAM"}, ""},
+		{[]string{"CAPABILITY_IAM"}, nil, "not allowed by the stack config: CAPABILITY_AUTO_EXPAND (nested stack Network)"},
+		{[]string{}, nil, "CAPABILITY_AUTO_EXPAND (nested stack Network); CAPABILITY_IAM (Role (AWS::IAM::Role))"},
+	}
+
+	for _, test := range tests {
+		c := &StackConfig{Capabilities: test.allowed}
+		caps, err := c.ResolveCapabilities(required)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Expected (%s), Found (%v)", test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error (%s)", err)
+		}
+		if !reflect.DeepEqual(test.expected, caps) {
+			t.Errorf("Expected (%s), Found (%s)", test.expected, caps)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	cf "github.com/aws/aws-sdk-go/service/cloudformation"
 	cfi "github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
 )
@@ -72,20 +73,88 @@ func GetStackEventsAfterTime(svc cfi.CloudFormationAPI, stackName string, ts tim
 	return events, nil
 }
 
+// StackOperation is the outcome of a stack operation, e.g. the execution of a
+// change set.
+type StackOperation struct {
+	// Status of the stack once the operation ended
+	Status string
+	// Events of the resources which failed during the operation in
+	// chronological order
+	Failures []*cf.StackEvent
+	// Time at which the stack started to roll back, or failed if the
+	// rollback is disabled; nil if it did neither
+	RollbackTime *time.Time
+}
+
+// Succeeded checks if the operation ended in a successful status. Rollbacks
+// and failed statuses, e.g. `UPDATE_ROLLBACK_COMPLETE` or `CREATE_FAILED`, are
+// failures.
+func (o *StackOperation) Succeeded() bool {
+	switch o.Status {
+	case cf.StackStatusCreateComplete, cf.StackStatusUpdateComplete, cf.StackStatusDeleteComplete, cf.StackStatusImportComplete:
+		return true
+	}
+	return false
+}
+
+// RootCauses returns the failures which are the likely root cause of a failed
+// operation, i.e. the earliest failures in chronological order. A failure
+// cascades: the operations of the other resources are cancelled and the stack
+// rolls back, during which further resources may fail. Hence only the
+// failures before the first cancellation or the rollback are returned, or the
+// first failure if there are none.
+func (o *StackOperation) RootCauses() []*cf.StackEvent {
+	end := o.RollbackTime
+	var causes []*cf.StackEvent
+	for _, e := range o.Failures {
+		if end != nil && e.Timestamp.After(*end) {
+			break
+		}
+		if strings.Contains(strings.ToLower(DerefString(e.ResourceStatusReason, "")), "cancelled") {
+			end = e.Timestamp
+			continue
+		}
+		causes = append(causes, e)
+	}
+	if len(causes) == 0 && len(o.Failures) > 0 {
+		return o.Failures[:1]
+	}
+	return causes
+}
+
+// IsTerminalStackStatus checks if the stack operation with the status has
+// ended, either successfully or not.
+func IsTerminalStackStatus(status string) bool {
+	return !strings.HasSuffix(status, "_IN_PROGRESS")
+}
+
+// stackEventsPollInterval is the time between the polls of the stack events
+// and status during a stack operation.
+var stackEventsPollInterval = 3 * time.Second
+
 // PrintStackEventsDuringOperation prints the most recent events happening
-// during an stack operation after the input time.
+// during a stack operation, e.g. a stack creation or update, and returns the
+// outcome of the operation.
+//
 // The events are writer using the input writer and stops when the stack
-// operation is complete.
+// operation has ended, i.e. the stack is no longer in an `_IN_PROGRESS`
+// status.
+//
+// The status of the stack read right after the operation is started may
+// still be the status in which the previous operation ended, e.g.
+// `UPDATE_COMPLETE`. Hence the operation is only considered to have ended once
+// it has been seen to start, i.e. the stack was in an `_IN_PROGRESS` status
+// or has events after the input time.
 //
 // TODO Add support for timeouts if the stack operation never completes
-// TODO Handle scenario when the stack is already in "_COMPLETE" state
-func PrintStackEventsDuringOperation(svc cfi.CloudFormationAPI, stackName string, lastEventTs time.Time, writer io.Writer) error {
-	opComplete := false
+func PrintStackEventsDuringOperation(svc cfi.CloudFormationAPI, stackName string, lastEventTs time.Time, writer io.Writer) (*StackOperation, error) {
+	op := &StackOperation{}
+	started := false
 
-	for !opComplete {
+	for {
 		events, err := GetStackEventsAfterTime(svc, stackName, lastEventTs)
 		if err != nil {
-			return fmt.Errorf("Failed to get stack events after time %s: ", lastEventTs.String, err)
+			return nil, fmt.Errorf("Failed to get stack events after time %s: %s", lastEventTs.String(), err.Error())
 		}
 
 		// Note that events are returned in reverse chronological order.
@@ -93,35 +162,120 @@ func PrintStackEventsDuringOperation(svc cfi.CloudFormationAPI, stackName string
 		for i := len(events) - 1; i >= 0; i-- {
 			_, err := writer.Write([]byte(events[i].String()))
 			if err != nil {
-				return fmt.Errorf("Failed to print stack event: %s", err.Error())
+				return nil, fmt.Errorf("Failed to print stack event: %s", err.Error())
 			}
+			recordStackEvent(op, stackName, events[i].event)
 		}
 
 		// Set the timestamp to the timestamp of the newest event seen
 		if len(events) > 0 {
 			lastEventTs = *events[0].event.Timestamp
+			started = true
 		}
 
 		dp := &cf.DescribeStacksInput{StackName: aws.String(stackName)}
 		r, err := svc.DescribeStacks(dp)
 		if err != nil {
-			return fmt.Errorf("Failed to fetch stack status: %s", err.Error())
+			return nil, fmt.Errorf("Failed to fetch stack status: %s", err.Error())
 		}
 		stack := r.Stacks[0]
-		stackStatus := *stack.StackStatus
-
-		// Check if the current stack status is in some "COMPLETE" state.
-		// This state could be rollback/create/delete completion and
-		// indicates the recent set of operations have completed.
-		if !strings.HasSuffix(stackStatus, "_COMPLETE") {
-			// Sleep for sometime to avoid calls with no new stack events
-			time.Sleep(3000 * time.Millisecond)
-		} else {
-			opComplete = true
+		op.Status = *stack.StackStatus
+
+		// A stack status which is not in progress, e.g. `UPDATE_COMPLETE`,
+		// `ROLLBACK_COMPLETE` or `UPDATE_ROLLBACK_FAILED`, indicates that the
+		// recent set of operations have ended once they have started.
+		if !IsTerminalStackStatus(op.Status) {
+			started = true
+		} else if started {
+			return op, nil
+		}
+
+		// Sleep for sometime to avoid calls with no new stack events
+		time.Sleep(stackEventsPollInterval)
+	}
+}
+
+// recordStackEvent records a failure of a resource or the start of the
+// rollback of the stack in the operation.
+func recordStackEvent(op *StackOperation, stackName string, e *cf.StackEvent) {
+	status := DerefString(e.ResourceStatus, "")
+	if DerefString(e.ResourceType, "") == "AWS::CloudFormation::Stack" && DerefString(e.LogicalResourceId, "") == stackName {
+		if op.RollbackTime == nil && (strings.HasSuffix(status, "ROLLBACK_IN_PROGRESS") || strings.HasSuffix(status, "_FAILED")) {
+			op.RollbackTime = e.Timestamp
+		}
+		return
+	}
+	if strings.HasSuffix(status, "_FAILED") {
+		op.Failures = append(op.Failures, e)
+	}
+}
+
+// DescribeStack returns the stack with the input name or nil if the stack
+// does not exist.
+//
+// Note that a stack whose first change set has been created but not executed
+// exists in the `REVIEW_IN_PROGRESS` state.
+func DescribeStack(svc cfi.CloudFormationAPI, stackName string) (*cf.Stack, error) {
+	r, err := svc.DescribeStacks(&cf.DescribeStacksInput{StackName: aws.String(stackName)})
+	if err != nil {
+		// ValidationError indicates a stack not found error
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "ValidationError" {
+			return nil, nil
 		}
+		return nil, err
+	}
+	if len(r.Stacks) == 0 {
+		return nil, nil
+	}
+	return r.Stacks[0], nil
+}
+
+// DeployedTemplate returns the template of the stack as it was submitted,
+// i.e. before any macros were processed.
+func DeployedTemplate(svc cfi.CloudFormationAPI, stackName string) (*Template, error) {
+	return getTemplate(svc, stackName, &cf.GetTemplateInput{
+		StackName:     aws.String(stackName),
+		TemplateStage: aws.String(cf.TemplateStageOriginal),
+	})
+}
+
+// DeployedTemplateHash returns the SHA-256 checksum of the template body of
+// the stack as it was submitted. It is used to detect changes to the template
+// of a stack since a plan was determined.
+func DeployedTemplateHash(svc cfi.CloudFormationAPI, stackName string) (string, error) {
+	r, err := svc.GetTemplate(&cf.GetTemplateInput{
+		StackName:     aws.String(stackName),
+		TemplateStage: aws.String(cf.TemplateStageOriginal),
+	})
+	if err != nil {
+		return "", err
+	}
+	return Checksum([]byte(DerefString(r.TemplateBody, ""))), nil
+}
+
+// ChangeSetTemplate returns the template of the change set, identified by its
+// ARN, as it was submitted. It is used to find the template of a nested stack
+// whose change set was created along with the change set of its parent.
+func ChangeSetTemplate(svc cfi.CloudFormationAPI, changeSetID string) (*Template, error) {
+	return getTemplate(svc, changeSetID, &cf.GetTemplateInput{
+		ChangeSetName: aws.String(changeSetID),
+		TemplateStage: aws.String(cf.TemplateStageOriginal),
+	})
+}
+
+// getTemplate retrieves and parses a template; the name is used as the name
+// of the template source.
+func getTemplate(svc cfi.CloudFormationAPI, name string, input *cf.GetTemplateInput) (*Template, error) {
+	r, err := svc.GetTemplate(input)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	tmpl := NewTemplate(MergeOptions{})
+	if err := tmpl.Add(name, []byte(DerefString(r.TemplateBody, ""))); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
 }
 
 // DerefString checks if the input string pointer is not nil and can be
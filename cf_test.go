@@ -0,0 +1,230 @@
+package cform
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	cf "github.com/aws/aws-sdk-go/service/cloudformation"
+	cfi "github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+)
+
+// mockEventsClient returns the stack events, newest first, and the status of
+// the stack of each poll. The events and the status of the last poll are
+// returned for any further polls.
+type mockEventsClient struct {
+	cfi.CloudFormationAPI
+
+	events   [][]*cf.StackEvent
+	statuses []string
+	polls    int
+}
+
+func (m *mockEventsClient) DescribeStackEventsPages(input *cf.DescribeStackEventsInput, fn func(*cf.DescribeStackEventsOutput, bool) bool) error {
+	fn(&cf.DescribeStackEventsOutput{StackEvents: m.events[minInt(m.polls, len(m.events)-1)]}, true)
+	return nil
+}
+
+func (m *mockEventsClient) DescribeStacks(input *cf.DescribeStacksInput) (*cf.DescribeStacksOutput, error) {
+	status := m.statuses[minInt(m.polls, len(m.statuses)-1)]
+	m.polls++
+	return &cf.DescribeStacksOutput{Stacks: []*cf.Stack{{StackStatus: aws.String(status)}}}, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+var eventsStart = time.Date(2017, 1, 25, 11, 0, 0, 0, time.UTC)
+
+// stackEvent returns an event of the resource, or of the stack if the ID is
+// `test-stack`, which happened the seconds after eventsStart.
+func stackEvent(seconds int, id, status, reason string) *cf.StackEvent {
+	resourceType := "AWS::S3::Bucket"
+	if id == "test-stack" {
+		resourceType = "AWS::CloudFormation::Stack"
+	}
+	return &cf.StackEvent{
+		Timestamp:            aws.Time(eventsStart.Add(time.Duration(seconds) * time.Second)),
+		LogicalResourceId:    aws.String(id),
+		ResourceType:         aws.String(resourceType),
+		ResourceStatus:       aws.String(status),
+		ResourceStatusReason: aws.String(reason),
+	}
+}
+
+func TestPrintStackEventsDuringOperation(t *testing.T) {
+	mock := &mockEventsClient{
+		events: [][]*cf.StackEvent{{
+			stackEvent(6, "test-stack", cf.StackStatusUpdateRollbackComplete, ""),
+			stackEvent(5, "test-stack", cf.StackStatusUpdateRollbackInProgress, "The following resource(s) failed to create: [Bucket]"),
+			stackEvent(4, "Logs", cf.ResourceStatusUpdateFailed, "Resource update cancelled"),
+			stackEvent(3, "Bucket", cf.ResourceStatusCreateFailed, "b1.isubuz.com already exists"),
+			stackEvent(2, "Bucket", cf.ResourceStatusCreateInProgress, ""),
+			stackEvent(1, "test-stack", cf.StackStatusUpdateInProgress, "User Initiated"),
+			stackEvent(0, "test-stack", cf.StackStatusUpdateComplete, ""),
+		}},
+		statuses: []string{cf.StackStatusUpdateRollbackComplete},
+	}
+
+	var buf bytes.Buffer
+	op, err := PrintStackEventsDuringOperation(mock, "test-stack", eventsStart, &buf)
+	if err != nil {
+		t.Fatalf("Unexpected error (%s)", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 6 {
+		t.Errorf("Expected (6) events, Found (%s)", buf.String())
+	}
+	if op.Succeeded() {
+		t.Errorf("Expected failure for status %s", op.Status)
+	}
+	if len(op.Failures) != 2 || *op.Failures[0].LogicalResourceId != "Bucket" {
+		t.Errorf("Expected failures of Bucket and Logs, Found (%v)", op.Failures)
+	}
+	if op.RollbackTime == nil || !op.RollbackTime.Equal(eventsStart.Add(5*time.Second)) {
+		t.Errorf("Expected (%s), Found (%v)", eventsStart.Add(5*time.Second), op.RollbackTime)
+	}
+	if causes := op.RootCauses(); len(causes) != 1 || *causes[0].LogicalResourceId != "Bucket" {
+		t.Errorf("Expected root cause Bucket, Found (%v)", causes)
+	}
+
+	tests := []struct {
+		status              string
+		terminal, succeeded bool
+	}{
+		{cf.StackStatusCreateComplete, true, true},
+		{cf.StackStatusUpdateComplete, true, true},
+		{cf.StackStatusRollbackComplete, true, false},
+		{cf.StackStatusUpdateRollbackComplete, true, false},
+		{cf.StackStatusCreateFailed, true, false},
+		{cf.StackStatusUpdateRollbackFailed, true, false},
+		{cf.StackStatusReviewInProgress, false, false},
+		{cf.StackStatusUpdateCompleteCleanupInProgress, false, false},
+		{cf.StackStatusUpdateRollbackInProgress, false, false},
+	}
+	for _, test := range tests {
+		op := &StackOperation{Status: test.status}
+		if IsTerminalStackStatus(test.status) != test.terminal || op.Succeeded() != test.succeeded {
+			t.Errorf("Expected (%t %t), Found (%t %t) for %s", test.terminal, test.succeeded,
+				IsTerminalStackStatus(test.status), op.Succeeded(), test.status)
+		}
+	}
+}
+
+// Test that a status which the previous operation ended in is not taken as
+// the outcome of the operation before the operation is seen to start
+func TestPrintStackEventsStaleStatus(t *testing.T) {
+	defer func(interval time.Duration) { stackEventsPollInterval = interval }(stackEventsPollInterval)
+	stackEventsPollInterval = time.Millisecond
+
+	previous := stackEvent(0, "test-stack", cf.StackStatusUpdateRollbackComplete, "")
+	tests := []struct {
+		events    [][]*cf.StackEvent
+		statuses  []string
+		status    string
+		succeeded bool
+	}{
+		{
+			[][]*cf.StackEvent{
+				{previous},
+				{previous},
+				{stackEvent(2, "test-stack", cf.StackStatusUpdateComplete, ""), stackEvent(1, "test-stack", cf.StackStatusUpdateInProgress, ""), previous},
+			},
+			[]string{cf.StackStatusUpdateRollbackComplete, cf.StackStatusUpdateInProgress, cf.StackStatusUpdateComplete},
+			cf.StackStatusUpdateComplete,
+			true,
+		},
+		{
+			[][]*cf.StackEvent{
+				{stackEvent(0, "test-stack", cf.StackStatusUpdateComplete, "")},
+				{stackEvent(0, "test-stack", cf.StackStatusUpdateComplete, "")},
+				{
+					stackEvent(4, "test-stack", cf.StackStatusUpdateRollbackComplete, ""),
+					stackEvent(3, "test-stack", cf.StackStatusUpdateRollbackInProgress, ""),
+					stackEvent(2, "Bucket", cf.ResourceStatusUpdateFailed, "Access Denied"),
+					stackEvent(1, "test-stack", cf.StackStatusUpdateInProgress, ""),
+				},
+			},
+			[]string{cf.StackStatusUpdateComplete, cf.StackStatusUpdateComplete, cf.StackStatusUpdateRollbackComplete},
+			cf.StackStatusUpdateRollbackComplete,
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		mock := &mockEventsClient{events: test.events, statuses: test.statuses}
+
+		op, err := PrintStackEventsDuringOperation(mock, "test-stack", eventsStart, ioutil.Discard)
+		if err != nil {
+			t.Errorf("Unexpected error (%s)", err)
+			continue
+		}
+		if op.Status != test.status || op.Succeeded() != test.succeeded {
+			t.Errorf("Expected (%s %t), Found (%s %t)", test.status, test.succeeded, op.Status, op.Succeeded())
+		}
+	}
+}
+
+func TestRootCauses(t *testing.T) {
+	tests := []struct {
+		failures     []*cf.StackEvent
+		rollbackTime time.Duration
+		causes       []string
+	}{
+		// The failures of the dependent resources during the rollback are
+		// caused by the failure of Role
+		{
+			[]*cf.StackEvent{
+				stackEvent(1, "Role", cf.ResourceStatusUpdateFailed, "Access Denied"),
+				stackEvent(2, "Function", cf.ResourceStatusUpdateFailed, "Resource update cancelled"),
+				stackEvent(4, "Policy", cf.ResourceStatusUpdateFailed, "Role test-role does not exist"),
+				stackEvent(5, "Function", cf.ResourceStatusUpdateFailed, "Policy test-policy does not exist"),
+			},
+			3 * time.Second,
+			[]string{"Role"},
+		},
+		// The resources which fail before the cancellations are the root
+		// causes even if the stack did not roll back
+		{
+			[]*cf.StackEvent{
+				stackEvent(1, "Bucket", cf.ResourceStatusCreateFailed, "b1.isubuz.com already exists"),
+				stackEvent(1, "Queue", cf.ResourceStatusCreateFailed, "Access Denied"),
+				stackEvent(2, "Logs", cf.ResourceStatusCreateFailed, "Resource creation cancelled"),
+				stackEvent(3, "Policy", cf.ResourceStatusCreateFailed, "Bucket b1.isubuz.com does not exist"),
+			},
+			0,
+			[]string{"Bucket", "Queue"},
+		},
+		{
+			[]*cf.StackEvent{
+				stackEvent(1, "Logs", cf.ResourceStatusCreateFailed, "Resource creation cancelled"),
+				stackEvent(2, "Queue", cf.ResourceStatusCreateFailed, "Resource creation cancelled"),
+			},
+			0,
+			[]string{"Logs"},
+		},
+		{nil, 0, nil},
+	}
+
+	for _, test := range tests {
+		op := &StackOperation{Failures: test.failures}
+		if test.rollbackTime != 0 {
+			op.RollbackTime = aws.Time(eventsStart.Add(test.rollbackTime))
+		}
+
+		var causes []string
+		for _, e := range op.RootCauses() {
+			causes = append(causes, *e.LogicalResourceId)
+		}
+		if !reflect.DeepEqual(causes, test.causes) {
+			t.Errorf("Expected (%v), Found (%v)", test.causes, causes)
+		}
+	}
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
-	"io/ioutil"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/fatih/color"
 	"github.com/isubuz/cform"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
@@ -26,19 +30,69 @@ var applyCmdFlags struct {
 	// contains the parameters which are usually passed to the `cloudformation`
 	// CLI command
 	stackConfigFile string
+
+	// Name of the environment whose stack config is read from the
+	// environments directory instead of the stack config file
+	env string
+
+	// Directory containing the stack configs of the environments
+	envDir string
+
+	// Parameter values written as `Key=Value` which override the values in
+	// the stack config
+	parameters []string
+
+	// The name of the change set which is created to apply the changes. By
+	// default a random timestamped name is generated.
+	changeSetName string
+
+	// If true, the changes are applied without asking for confirmation.
+	autoApprove bool
+
+	// Maximum time to wait for the change set to be created
+	changeSetTimeout time.Duration
+
+	// Logical IDs of the stateful or protected resources which may be
+	// replaced
+	allowReplace []string
+
+	// If true, resources may be removed even if they are deleted
+	allowDestroy bool
 }
 
 var applyCmd = &cobra.Command{
-	Use:   "apply",
+	Use:   "apply [plan-file]",
 	Short: "Create or update a CloudFormation stack",
+	Long: `Create or update a CloudFormation stack.
+
+If a plan file saved by "cform plan --out" is passed, the change set of the
+plan is executed instead.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		changeSetWait.timeout = applyCmdFlags.changeSetTimeout
+
+		// Set random change set name if not passed
+		if applyCmdFlags.changeSetName == "" {
+			applyCmdFlags.changeSetName = newChangeSetName()
+		}
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := mergeFromDir(rootCmdFlags.tmplSrc, rootCmdFlags.tmplOut); err != nil {
+		if len(args) > 1 {
+			log.Error(errors.New("at most one plan file can be applied"))
 			os.Exit(-1)
 		}
+		if len(args) == 1 {
+			runApplyPlan(args[0])
+			return
+		}
 
-		tmpl, err := ioutil.ReadFile(rootCmdFlags.tmplOut)
+		cfg, err := readStackConfig(applyCmdFlags.stackConfigFile, applyCmdFlags.envDir, applyCmdFlags.env, applyCmdFlags.stackName,
+			applyCmdFlags.parameters)
+		if err != nil {
+			os.Exit(-1)
+		}
+
+		tmpl, err := mergeFromDir(rootCmdFlags.tmplSrc, rootCmdFlags.tmplOut, readerOpts, mergeOpts)
 		if err != nil {
-			log.WithError(err).Error("cannot read merged template file")
 			os.Exit(-1)
 		}
 
@@ -49,81 +103,294 @@ var applyCmd = &cobra.Command{
 		}
 
 		svc := cloudformation.New(sess)
-		if err := apply(svc, string(tmpl), planCmdFlags.stackConfigFile, planCmdFlags.stackName); err != nil {
+		approvals := riskApprovals{replace: applyCmdFlags.allowReplace, destroy: applyCmdFlags.allowDestroy}
+		if err := apply(svc, tmpl, cfg, applyCmdFlags.changeSetName, applyCmdFlags.autoApprove, approvals); err != nil {
 			os.Exit(-1)
 		}
 	},
 }
 
-func apply(svc cloudformationiface.CloudFormationAPI, tmpl, stackConfigFile, stackName string) error {
-	var stackExists bool
-	descInput := &cloudformation.DescribeStacksInput{
-		StackName: aws.String(stackName),
+// runApplyPlan executes the change set of the plan saved to the file.
+func runApplyPlan(planFile string) {
+	if applyCmdFlags.stackName != "" || applyCmdFlags.stackConfigFile != "" || applyCmdFlags.env != "" || len(applyCmdFlags.parameters) > 0 {
+		log.Error(errors.New("stack config cannot be used with a saved plan"))
+		os.Exit(-1)
 	}
 
-	// Check if stack exists
-	_, err := svc.DescribeStacks(descInput)
+	p, err := cform.ReadPlan(planFile)
 	if err != nil {
-		awsErr := err.(awserr.Error)
-
-		// ValidationError indicates a stack not found error.
-		// TODO can a constant be used?
-		if awsErr.Code() == "ValidationError" {
-			log.WithField("stack-name", stackName).Debug("stack does not exist; running create mode")
-			stackExists = false
-		} else {
-			log.WithError(err).Error("unknown error encountered")
-			return err
-		}
-	} else {
-		log.WithField("stack-name", stackName).Debug("stack exists; running update mode")
-		stackExists = true
+		log.WithError(err).Error("cannot read plan")
+		os.Exit(-1)
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		log.WithError(err).Error("failed to create session")
+		os.Exit(-1)
+	}
+
+	svc := cloudformation.New(sess)
+	approvals := riskApprovals{replace: applyCmdFlags.allowReplace, destroy: applyCmdFlags.allowDestroy}
+	if err := applyPlan(svc, p, approvals); err != nil {
+		os.Exit(-1)
+	}
+}
+
+// applyPlan executes the change set of the plan and prints the stack events
+// until the operation completes. It fails if the stack or the change set has
+// changed since the plan was determined or if the plan has changes which may
+// lose data and are not approved.
+func applyPlan(svc cloudformationiface.CloudFormationAPI, p *cform.Plan, approvals riskApprovals) error {
+	fmt.Printf("Executing change set %s of stack %s\n\n", p.ChangeSetName, p.StackName)
+	if err := writeTextPlan(os.Stdout, p, nil); err != nil {
+		log.WithError(err).Error("cannot print plan")
+		return err
+	}
+
+	if err := approvals.check(p); err != nil {
+		return err
+	}
+
+	if err := p.Verify(svc); err != nil {
+		log.WithError(err).Error("cannot apply plan; run plan again")
+		return err
 	}
+	return executePlan(svc, p)
+}
 
-	var ts time.Time
+// executePlan executes the change set of the plan and prints the stack events
+// until the operation ends. It fails if the operation fails or is rolled back,
+// in which case the failed resources are summarised. The stack settings which
+// are not part of the change set are set only once the operation succeeds so
+// that a failed operation leaves the stack unchanged.
+func executePlan(svc cloudformationiface.CloudFormationAPI, p *cform.Plan) error {
+	ts, err := lastStackEventTime(svc, p.StackID)
+	if err != nil {
+		log.WithError(err).Error("cannot retrieve stack events")
+		return err
+	}
 
-	if !stackExists {
-		p := &cloudformation.CreateStackInput{
-			StackName:    aws.String(stackName),
-			TemplateBody: aws.String(tmpl),
+	execInput := &cloudformation.ExecuteChangeSetInput{
+		ChangeSetName: aws.String(p.ChangeSetID),
+		StackName:     aws.String(p.StackID),
+	}
+	if _, err := svc.ExecuteChangeSet(execInput); err != nil {
+		log.WithError(err).Error("cannot execute change set")
+		return err
+	}
+	log.WithField("change-set-arn", p.ChangeSetID).Debug("executing change set")
+
+	op, err := cform.PrintStackEventsDuringOperation(svc, p.StackName, ts, os.Stdout)
+	if err != nil {
+		log.WithError(err).Error("cannot print stack events")
+		return err
+	}
+
+	if !op.Succeeded() {
+		writeFailureSummary(os.Stdout, op)
+		err := fmt.Errorf("stack operation failed with status %s", op.Status)
+		log.WithField("stack-name", p.StackName).Error(err)
+		return err
+	}
+	return setStackSettings(svc, p)
+}
+
+// setStackSettings sets the termination protection and the stack policy of
+// the plan, if any, which are not part of the change set.
+func setStackSettings(svc cloudformationiface.CloudFormationAPI, p *cform.Plan) error {
+	if p.TerminationProtection != nil {
+		tp := &cloudformation.UpdateTerminationProtectionInput{
+			StackName:                   aws.String(p.StackID),
+			EnableTerminationProtection: p.TerminationProtection,
 		}
-		_, err := svc.CreateStack(p)
-		if err != nil {
-			log.WithError(err).Error("cannot create stack")
+		if _, err := svc.UpdateTerminationProtection(tp); err != nil {
+			log.WithError(err).Error("cannot update termination protection")
 			return err
 		}
-		ts = time.Now().UTC()
-	} else {
-		// Get the timestamp of the last stack event
-		p0 := &cloudformation.DescribeStackEventsInput{
-			StackName: aws.String(stackName),
+	}
+	if p.StackPolicyBody != "" {
+		sp := &cloudformation.SetStackPolicyInput{
+			StackName:       aws.String(p.StackID),
+			StackPolicyBody: aws.String(p.StackPolicyBody),
 		}
-		resp, err := svc.DescribeStackEvents(p0)
-		if err != nil {
+		if _, err := svc.SetStackPolicy(sp); err != nil {
+			log.WithError(err).Error("cannot set stack policy")
 			return err
 		}
-		ts = *resp.StackEvents[0].Timestamp
+	}
+	return nil
+}
+
+// writeFailureSummary writes the status of a failed stack operation along
+// with the earliest failed resources and the reasons why they failed, which
+// are the likely root cause of the failure.
+func writeFailureSummary(w io.Writer, op *cform.StackOperation) {
+	red := color.New(color.FgRed, color.Bold)
+	red.Fprintf(w, "\nStack operation failed with status %s\n", op.Status)
+
+	causes := op.RootCauses()
+	if len(causes) == 0 {
+		fmt.Fprintln(w, "No resource failed; see the stack events for the reason")
+		return
+	}
 
-		p := &cloudformation.UpdateStackInput{
-			StackName:    aws.String(stackName),
-			TemplateBody: aws.String(tmpl),
+	fmt.Fprintln(w, "Earliest failed resources, which are the likely root cause:")
+	for _, e := range causes {
+		fmt.Fprintf(w, "\t%s (%s) %s: %s\n", cform.DerefString(e.LogicalResourceId, ""), cform.DerefString(e.ResourceType, ""),
+			cform.DerefString(e.ResourceStatus, ""), orNA(cform.DerefString(e.ResourceStatusReason, "")))
+	}
+}
+
+// lastStackEventTime returns the timestamp of the most recent event of the
+// stack.
+func lastStackEventTime(svc cloudformationiface.CloudFormationAPI, stackName string) (time.Time, error) {
+	resp, err := svc.DescribeStackEvents(&cloudformation.DescribeStackEventsInput{
+		StackName: aws.String(stackName),
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(resp.StackEvents) == 0 {
+		return time.Time{}, nil
+	}
+	return *resp.StackEvents[0].Timestamp, nil
+}
+
+// riskApprovals are the changes which may lose data that are approved to be
+// applied.
+type riskApprovals struct {
+	// Logical IDs of the resources which may be replaced
+	replace []string
+	// If true, resources may be removed
+	destroy bool
+}
+
+// check checks if every change of the plan which may lose data is approved.
+// The changes which are not approved are logged along with the flag which
+// approves them.
+func (a riskApprovals) check(p *cform.Plan) error {
+	var refused []string
+	for _, c := range p.RiskyChanges() {
+		var flag string
+		switch c.Risk {
+		case cform.RiskReplace:
+			if a.allowsReplace(c.LogicalResourceID) {
+				continue
+			}
+			flag = "--allow-replace=" + c.LogicalResourceID
+		case cform.RiskDestroy:
+			if a.destroy {
+				continue
+			}
+			flag = "--allow-destroy"
 		}
-		_, err = svc.UpdateStack(p)
-		if err != nil {
-			log.WithError(err).Error("cannot update stack")
+
+		log.WithFields(log.Fields{
+			"logical-id":    c.LogicalResourceID,
+			"resource-type": c.ResourceType,
+			"risk":          c.Risk,
+			"reason":        c.RiskReason,
+			"approve-with":  flag,
+		}).Error("change may lose data")
+		refused = append(refused, c.LogicalResourceID)
+	}
+
+	if len(refused) > 0 {
+		return fmt.Errorf("refusing to apply changes which may lose data to %s", strings.Join(refused, ", "))
+	}
+	return nil
+}
+
+// allowsReplace checks if the resource with the logical ID may be replaced.
+func (a riskApprovals) allowsReplace(logicalID string) bool {
+	for _, id := range a.replace {
+		if id == logicalID {
+			return true
+		}
+	}
+	return false
+}
+
+// errApplyCancelled is returned if the changes are not approved.
+var errApplyCancelled = errors.New("apply cancelled")
+
+// apply creates a change set using the input template and stack config,
+// prints the plan and, once the changes are approved, executes the change set
+// and prints the stack events until the operation completes. The change set
+// is deleted if the changes are not approved, including any changes which may
+// lose data that are not approved using the risk approvals.
+func apply(svc cloudformationiface.CloudFormationAPI, tmpl *cform.Template, cfg *cform.StackConfig, changeSetName string, autoApprove bool,
+	approvals riskApprovals) error {
+	p, discard, err := createPlan(svc, tmpl, cfg, changeSetName)
+	if err == errNoChanges {
+		discard()
+		if err := writeNoChanges(os.Stdout, textFormat, cfg.StackName); err != nil {
+			log.WithError(err).Error("cannot write plan")
 			return err
 		}
+		return nil
 	}
-	if err = cform.PrintStackEventsDuringOperation(svc, stackName, ts, os.Stdout); err != nil {
-		log.WithError(err).Error("cannot print stack events")
+	if err != nil {
+		if discard != nil {
+			discard()
+		}
 		return err
 	}
-	return nil
+
+	if err := writeTextPlan(os.Stdout, p, tmpl.Capabilities()); err != nil {
+		log.WithError(err).Error("cannot print plan")
+		discard()
+		return err
+	}
+
+	if err := approvals.check(p); err != nil {
+		discard()
+		return err
+	}
+
+	if !autoApprove {
+		approved, err := confirmApply(os.Stdin)
+		if err != nil {
+			log.WithError(err).Error("cannot ask for confirmation; use --auto-approve to apply without confirmation")
+			discard()
+			return err
+		}
+		if !approved {
+			log.Error(errApplyCancelled)
+			discard()
+			return errApplyCancelled
+		}
+	}
+
+	return executePlan(svc, p)
+}
+
+// confirmApply asks whether the changes should be applied on the terminal and
+// checks if the answer is `yes`. It fails if the input is not a terminal.
+var confirmApply = func(in *os.File) (bool, error) {
+	if !isTerminal(in) {
+		return false, errors.New("input is not a terminal")
+	}
+
+	fmt.Print("Do you want to apply these changes? Only 'yes' will be accepted: ")
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return strings.TrimSpace(answer) == "yes", nil
 }
 
 func init() {
-	applyCmd.Flags().StringVar(&planCmdFlags.stackName, "stack-name", "", "Name of the CloudFormation stack")
-	applyCmd.Flags().StringVar(&planCmdFlags.stackConfigFile, "stack-config", "", "Path to stack config file")
+	applyCmd.Flags().StringVar(&applyCmdFlags.stackName, "stack-name", "", "Name of the CloudFormation stack")
+	applyCmd.Flags().StringVar(&applyCmdFlags.stackConfigFile, "stack-config", "", "Path to stack config file")
+	applyCmd.Flags().StringVar(&applyCmdFlags.env, "env", "", "Name of the environment whose stack config is used")
+	applyCmd.Flags().StringVar(&applyCmdFlags.envDir, "env-dir", "environments", "Directory containing the stack configs of the environments")
+	applyCmd.Flags().StringArrayVar(&applyCmdFlags.parameters, "parameter", nil, "Parameter value as Key=Value which overrides the stack config; can be repeated")
+	applyCmd.Flags().StringVar(&applyCmdFlags.changeSetName, "change-set-name", "", "Name of the change set")
+	applyCmd.Flags().BoolVar(&applyCmdFlags.autoApprove, "auto-approve", false, "Apply the changes without asking for confirmation")
+	applyCmd.Flags().StringSliceVar(&applyCmdFlags.allowReplace, "allow-replace", nil, "Logical IDs of the stateful or protected resources which may be replaced")
+	applyCmd.Flags().BoolVar(&applyCmdFlags.allowDestroy, "allow-destroy", false, "Allow removing resources which are deleted along with their data")
+	applyCmd.Flags().DurationVar(&applyCmdFlags.changeSetTimeout, "change-set-timeout", changeSetWait.timeout, "Maximum time to wait for the change set to be created")
 
 	rootCmd.AddCommand(applyCmd)
 }
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	cf "github.com/aws/aws-sdk-go/service/cloudformation"
+	cfi "github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/isubuz/cform"
+)
+
+// mockApplyClient describes a stack and the status of its change set and
+// records the executed or deleted change set and the calls which change the
+// stack in order.
+type mockApplyClient struct {
+	cfi.CloudFormationAPI
+
+	stack    *cf.Stack
+	executed string
+	calls    []string
+
+	// Status and reason of the created change set
+	csStatus       string
+	csStatusReason string
+	deleted        string
+
+	// Events, newest first, and status of the stack once the change set is
+	// executed; the update succeeds by default
+	events      []*cf.StackEvent
+	finalStatus string
+}
+
+func (m *mockApplyClient) CreateChangeSet(input *cf.CreateChangeSetInput) (*cf.CreateChangeSetOutput, error) {
+	return &cf.CreateChangeSetOutput{Id: aws.String(*input.ChangeSetName + "-id"), StackId: m.stack.StackId}, nil
+}
+
+func (m *mockApplyClient) DescribeChangeSet(input *cf.DescribeChangeSetInput) (*cf.DescribeChangeSetOutput, error) {
+	change := &cf.Change{ResourceChange: &cf.ResourceChange{
+		Action:            aws.String(cf.ChangeActionAdd),
+		LogicalResourceId: aws.String("Bucket"),
+		ResourceType:      aws.String("AWS::S3::Bucket"),
+	}}
+	return &cf.DescribeChangeSetOutput{
+		Status:       aws.String(m.csStatus),
+		StatusReason: aws.String(m.csStatusReason),
+		Changes:      []*cf.Change{change},
+	}, nil
+}
+
+func (m *mockApplyClient) DeleteChangeSet(input *cf.DeleteChangeSetInput) (*cf.DeleteChangeSetOutput, error) {
+	m.deleted = *input.ChangeSetName
+	return &cf.DeleteChangeSetOutput{}, nil
+}
+
+func (m *mockApplyClient) DescribeStacks(input *cf.DescribeStacksInput) (*cf.DescribeStacksOutput, error) {
+	return &cf.DescribeStacksOutput{Stacks: []*cf.Stack{m.stack}}, nil
+}
+
+func (m *mockApplyClient) GetTemplate(input *cf.GetTemplateInput) (*cf.GetTemplateOutput, error) {
+	return &cf.GetTemplateOutput{TemplateBody: aws.String("Resources: {}\n")}, nil
+}
+
+func (m *mockApplyClient) DescribeStackEvents(input *cf.DescribeStackEventsInput) (*cf.DescribeStackEventsOutput, error) {
+	if m.executed != "" {
+		events := m.events
+		if events == nil {
+			events = []*cf.StackEvent{{
+				Timestamp:         aws.Time(time.Date(2017, 1, 25, 11, 2, 0, 0, time.UTC)),
+				LogicalResourceId: aws.String("test-stack"),
+				ResourceType:      aws.String("AWS::CloudFormation::Stack"),
+				ResourceStatus:    m.stack.StackStatus,
+			}}
+		}
+		return &cf.DescribeStackEventsOutput{StackEvents: events}, nil
+	}
+	event := &cf.StackEvent{Timestamp: aws.Time(time.Date(2017, 1, 25, 11, 0, 0, 0, time.UTC))}
+	return &cf.DescribeStackEventsOutput{StackEvents: []*cf.StackEvent{event}}, nil
+}
+
+func (m *mockApplyClient) DescribeStackEventsPages(input *cf.DescribeStackEventsInput, fn func(*cf.DescribeStackEventsOutput, bool) bool) error {
+	r, _ := m.DescribeStackEvents(input)
+	fn(r, true)
+	return nil
+}
+
+func (m *mockApplyClient) UpdateTerminationProtection(input *cf.UpdateTerminationProtectionInput) (*cf.UpdateTerminationProtectionOutput, error) {
+	m.calls = append(m.calls, "UpdateTerminationProtection")
+	return &cf.UpdateTerminationProtectionOutput{}, nil
+}
+
+func (m *mockApplyClient) SetStackPolicy(input *cf.SetStackPolicyInput) (*cf.SetStackPolicyOutput, error) {
+	m.calls = append(m.calls, "SetStackPolicy")
+	return &cf.SetStackPolicyOutput{}, nil
+}
+
+func (m *mockApplyClient) ExecuteChangeSet(input *cf.ExecuteChangeSetInput) (*cf.ExecuteChangeSetOutput, error) {
+	m.calls = append(m.calls, "ExecuteChangeSet")
+	m.executed = *input.ChangeSetName
+	m.stack.StackStatus = aws.String(cf.StackStatusUpdateComplete)
+	if m.finalStatus != "" {
+		m.stack.StackStatus = aws.String(m.finalStatus)
+	}
+	return &cf.ExecuteChangeSetOutput{}, nil
+}
+
+// Test execution of the change set of a saved plan and refusal to execute it
+// if the stack or its template has changed since the plan
+func TestApplyPlan(t *testing.T) {
+	lastUpdated := time.Date(2017, 1, 7, 23, 31, 1, 0, time.UTC)
+	hash := cform.Checksum([]byte("Resources: {}\n"))
+
+	tests := []struct {
+		lastUpdated  *time.Time
+		status       string
+		templateHash string
+		err          string
+	}{
+		{&lastUpdated, cf.StackStatusUpdateComplete, hash, ""},
+		{&lastUpdated, cf.StackStatusUpdateComplete, "", ""},
+		{aws.Time(lastUpdated.Add(time.Minute)), cf.StackStatusUpdateComplete, hash, "has been updated since the plan"},
+		{&lastUpdated, cf.StackStatusDeleteComplete, hash, "has been deleted since the plan"},
+		{&lastUpdated, cf.StackStatusUpdateComplete, cform.Checksum([]byte("Resources: {Bucket: {}}\n")), "Template of stack test-stack has changed since the plan"},
+	}
+
+	for _, test := range tests {
+		p := &cform.Plan{
+			Version:              cform.PlanVersion,
+			StackName:            "test-stack",
+			StackID:              "test-stack-id",
+			StackLastUpdatedTime: &lastUpdated,
+			ChangeSetID:          "testcs-id",
+			ChangeSetName:        "testcs",
+			TemplateHash:         test.templateHash,
+		}
+		mock := &mockApplyClient{
+			stack: &cf.Stack{
+				StackId:         aws.String("test-stack-id"),
+				StackStatus:     aws.String(test.status),
+				LastUpdatedTime: test.lastUpdated,
+			},
+		}
+
+		err := applyPlan(mock, p, riskApprovals{})
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("Unexpected error (%s)", err)
+			}
+			if mock.executed != p.ChangeSetID {
+				t.Errorf("Expected (%s), Found (%s)", p.ChangeSetID, mock.executed)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected (%s), Found (%v)", test.err, err)
+		}
+		if mock.executed != "" {
+			t.Errorf("Unexpected execution of change set %s", mock.executed)
+		}
+	}
+}
+
+// Test refusal to apply changes which may lose data unless they are approved
+func TestRiskApprovals(t *testing.T) {
+	p := &cform.Plan{
+		Version:       cform.PlanVersion,
+		StackName:     "test-stack",
+		StackID:       "test-stack-id",
+		ChangeSetID:   "testcs-id",
+		ChangeSetName: "testcs",
+		Changes: []cform.PlanChange{
+			{Action: cf.ChangeActionModify, LogicalResourceID: "Database", ResourceType: "AWS::RDS::DBInstance", Risk: cform.RiskReplace},
+			{Action: cf.ChangeActionModify, LogicalResourceID: "Table", ResourceType: "AWS::DynamoDB::Table", Risk: cform.RiskReplace},
+			{Action: cf.ChangeActionRemove, LogicalResourceID: "Topic", ResourceType: "AWS::SNS::Topic", Risk: cform.RiskDestroy},
+			{Action: cf.ChangeActionAdd, LogicalResourceID: "Queue", ResourceType: "AWS::SQS::Queue"},
+		},
+	}
+
+	tests := []struct {
+		approvals riskApprovals
+		err       string
+	}{
+		{riskApprovals{}, "refusing to apply changes which may lose data to Database, Table, Topic"},
+		{riskApprovals{replace: []string{"Database"}, destroy: true}, "refusing to apply changes which may lose data to Table"},
+		{riskApprovals{replace: []string{"Table"}}, "refusing to apply changes which may lose data to Database, Topic"},
+		{riskApprovals{replace: []string{"Database", "Table"}, destroy: true}, ""},
+	}
+	for _, test := range tests {
+		var found string
+		if err := test.approvals.check(p); err != nil {
+			found = err.Error()
+		}
+		if found != test.err {
+			t.Errorf("Expected (%s), Found (%s)", test.err, found)
+		}
+	}
+
+	// The change set of a saved plan is not executed
+	mock := &mockApplyClient{stack: &cf.Stack{StackId: aws.String("test-stack-id"), StackStatus: aws.String(cf.StackStatusUpdateComplete)}}
+	if err := applyPlan(mock, p, riskApprovals{}); err == nil {
+		t.Errorf("Expected error for changes which may lose data")
+	}
+	if mock.executed != "" {
+		t.Errorf("Unexpected execution of change set %s", mock.executed)
+	}
+}
+
+// Test execution of the change set created by apply once the changes are
+// approved and deletion of the change set otherwise
+func TestApply(t *testing.T) {
+	defer func(f func(*os.File) (bool, error)) { confirmApply = f }(confirmApply)
+
+	noChanges := "The submitted information didn't contain changes. Submit different information to create a change set."
+
+	tests := []struct {
+		csStatus, csStatusReason string
+		autoApprove              bool
+		approved                 bool
+		confirmErr               error
+		err                      error
+		executed, deleted        string
+	}{
+		{cf.ChangeSetStatusCreateComplete, "", true, false, nil, nil, "testcs-id", ""},
+		{cf.ChangeSetStatusCreateComplete, "", false, true, nil, nil, "testcs-id", ""},
+		{cf.ChangeSetStatusCreateComplete, "", false, false, nil, errApplyCancelled, "", "testcs"},
+		{cf.ChangeSetStatusCreateComplete, "", false, false, errors.New("input is not a terminal"), errors.New("input is not a terminal"), "", "testcs"},
+		{cf.ChangeSetStatusFailed, noChanges, false, false, nil, nil, "", "testcs"},
+	}
+
+	for _, test := range tests {
+		confirmApply = func(*os.File) (bool, error) {
+			if test.autoApprove {
+				t.Errorf("Unexpected confirmation with --auto-approve")
+			}
+			return test.approved, test.confirmErr
+		}
+
+		mock := &mockApplyClient{
+			stack: &cf.Stack{
+				StackId:     aws.String("test-stack-id"),
+				StackStatus: aws.String(cf.StackStatusCreateComplete),
+			},
+			csStatus:       test.csStatus,
+			csStatusReason: test.csStatusReason,
+		}
+		cfg := &cform.StackConfig{StackName: "test-stack"}
+
+		err := apply(mock, cform.NewTemplate(cform.MergeOptions{}), cfg, "testcs", test.autoApprove, riskApprovals{})
+		if fmt.Sprint(err) != fmt.Sprint(test.err) {
+			t.Errorf("Expected (%v), Found (%v)", test.err, err)
+		}
+		if mock.executed != test.executed {
+			t.Errorf("Expected executed (%s), Found (%s)", test.executed, mock.executed)
+		}
+		if mock.deleted != test.deleted {
+			t.Errorf("Expected deleted (%s), Found (%s)", test.deleted, mock.deleted)
+		}
+	}
+}
+
+// Test failure of apply when the stack operation is rolled back
+func TestApplyRollback(t *testing.T) {
+	failed := &cf.StackEvent{
+		Timestamp:            aws.Time(time.Date(2017, 1, 25, 11, 1, 0, 0, time.UTC)),
+		LogicalResourceId:    aws.String("Bucket"),
+		ResourceType:         aws.String("AWS::S3::Bucket"),
+		ResourceStatus:       aws.String(cf.ResourceStatusCreateFailed),
+		ResourceStatusReason: aws.String("b1.isubuz.com already exists"),
+	}
+	mock := &mockApplyClient{
+		stack: &cf.Stack{
+			StackId:     aws.String("test-stack-id"),
+			StackStatus: aws.String(cf.StackStatusUpdateComplete),
+		},
+		events:      []*cf.StackEvent{failed},
+		finalStatus: cf.StackStatusUpdateRollbackComplete,
+	}
+	p := &cform.Plan{Version: cform.PlanVersion, StackName: "test-stack", StackID: "test-stack-id", ChangeSetID: "testcs-id"}
+
+	err := executePlan(mock, p)
+	expected := "stack operation failed with status UPDATE_ROLLBACK_COMPLETE"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected (%s), Found (%v)", expected, err)
+	}
+
+	var buf bytes.Buffer
+	writeFailureSummary(&buf, &cform.StackOperation{Status: cf.StackStatusUpdateRollbackComplete, Failures: []*cf.StackEvent{failed}})
+	if !strings.Contains(buf.String(), "Bucket (AWS::S3::Bucket) CREATE_FAILED: b1.isubuz.com already exists") {
+		t.Errorf("Expected failure of Bucket, Found (%s)", buf.String())
+	}
+}
+
+// Test that the stack settings of the plan are set only once the change set
+// has been executed successfully
+func TestExecutePlanStackSettings(t *testing.T) {
+	tests := []struct {
+		finalStatus string
+		calls       []string
+	}{
+		{cf.StackStatusCreateComplete, []string{"ExecuteChangeSet", "UpdateTerminationProtection", "SetStackPolicy"}},
+		{cf.StackStatusRollbackComplete, []string{"ExecuteChangeSet"}},
+	}
+
+	for _, test := range tests {
+		mock := &mockApplyClient{
+			stack: &cf.Stack{
+				StackId:     aws.String("test-stack-id"),
+				StackStatus: aws.String(cf.StackStatusReviewInProgress),
+			},
+			finalStatus: test.finalStatus,
+		}
+		p := &cform.Plan{
+			Version:               cform.PlanVersion,
+			StackName:             "test-stack",
+			StackID:               "test-stack-id",
+			ChangeSetID:           "testcs-id",
+			ChangeSetType:         cf.ChangeSetTypeCreate,
+			TerminationProtection: aws.Bool(true),
+			StackPolicyBody:       `{"Statement": []}`,
+		}
+
+		err := executePlan(mock, p)
+		if (err == nil) != (test.finalStatus == cf.StackStatusCreateComplete) {
+			t.Errorf("Unexpected result (%v) for status %s", err, test.finalStatus)
+		}
+		if !reflect.DeepEqual(mock.calls, test.calls) {
+			t.Errorf("Expected (%v), Found (%v)", test.calls, mock.calls)
+		}
+	}
+}
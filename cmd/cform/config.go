@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var configCmdFlags struct {
+	// Name of the CloudFormation stack
+	stackName string
+
+	// Stack configuration file containing details of the stack
+	stackConfigFile string
+
+	// Name of the environment whose stack config is read from the
+	// environments directory instead of the stack config file
+	env string
+
+	// Directory containing the stack configs of the environments
+	envDir string
+
+	// Parameter values written as `Key=Value` which override the values in
+	// the stack config
+	parameters []string
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Show the effective stack config used by plan and apply",
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := readStackConfig(configCmdFlags.stackConfigFile, configCmdFlags.envDir, configCmdFlags.env, configCmdFlags.stackName,
+			configCmdFlags.parameters)
+		if err != nil {
+			os.Exit(-1)
+		}
+
+		b, err := cfg.Marshal()
+		if err != nil {
+			log.WithError(err).Error("cannot generate stack config")
+			os.Exit(-1)
+		}
+		os.Stdout.Write(b)
+	},
+}
+
+func init() {
+	configCmd.Flags().StringVar(&configCmdFlags.stackName, "stack-name", "", "Name of the CloudFormation stack")
+	configCmd.Flags().StringVar(&configCmdFlags.stackConfigFile, "stack-config", "", "Path to stack config file")
+	configCmd.Flags().StringVar(&configCmdFlags.env, "env", "", "Name of the environment whose stack config is used")
+	configCmd.Flags().StringVar(&configCmdFlags.envDir, "env-dir", "environments", "Directory containing the stack configs of the environments")
+	configCmd.Flags().StringArrayVar(&configCmdFlags.parameters, "parameter", nil, "Parameter value as Key=Value which overrides the stack config; can be repeated")
+
+	rootCmd.AddCommand(configCmd)
+}
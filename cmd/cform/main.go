@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/fatih/color"
 
+	"github.com/isubuz/cform"
 	"github.com/spf13/cobra"
 )
 
@@ -14,8 +17,25 @@ var rootCmdFlags struct {
 	tmplSrc       string
 	tmplOut       string
 	tmplOverwrite bool
+	intrinsicForm string
+	outputFormat  string
+	annotate      bool
+	allowOverride bool
+	include       []string
+	exclude       []string
 }
 
+// errorExitCode is the exit code of a command which fails. It is 1 for the
+// plan command with detailed exit codes, where 2 means that there are changes.
+var errorExitCode = -1
+
+// Options used to read and merge the templates which are derived from the
+// root command flags.
+var (
+	readerOpts cform.DirectoryReaderOptions
+	mergeOpts  cform.MergeOptions
+)
+
 var rootCmd = &cobra.Command{
 	Use:   "cform",
 	Short: "CloudFormation utility which provides Terraform-like CLI functionalities",
@@ -23,12 +43,47 @@ var rootCmd = &cobra.Command{
 		if rootCmdFlags.debug {
 			log.SetLevel(log.DebugLevel)
 		}
+		if cmd == planCmd && planCmdFlags.detailedExitCode {
+			errorExitCode = 1
+		}
+
+		// Color codes are only written to terminals
+		if !isTerminal(os.Stdout) {
+			color.NoColor = true
+		}
+
+		readerOpts.Include = rootCmdFlags.include
+		readerOpts.Exclude = rootCmdFlags.exclude
+
+		form, err := cform.ParseIntrinsicForm(rootCmdFlags.intrinsicForm)
+		if err != nil {
+			log.WithError(err).Error("Invalid intrinsic function form")
+			os.Exit(errorExitCode)
+		}
+		mergeOpts.IntrinsicForm = form
+
+		format, err := cform.ParseFormat(rootCmdFlags.outputFormat)
+		if err != nil {
+			log.WithError(err).Error("Invalid output format")
+			os.Exit(errorExitCode)
+		}
+		mergeOpts.Format = format
+		mergeOpts.AllowOverride = rootCmdFlags.allowOverride
+		mergeOpts.AnnotateSources = rootCmdFlags.annotate
+		mergeOpts.OnOverride = func(o cform.Override) {
+			log.WithFields(log.Fields{
+				"section":       o.Section,
+				"key":           o.Key,
+				"source":        o.Source.String(),
+				"overridden-by": o.OverriddenBy.String(),
+			}).Warn("overriding template entry")
+		}
 
 		if rootCmdFlags.tmplOut == "" {
 			f, err := ioutil.TempFile("", "cform")
 			if err != nil {
 				log.Error("Cannot create output file for generated template")
-				os.Exit(-1)
+				os.Exit(errorExitCode)
 			}
 			rootCmdFlags.tmplOut = f.Name()
 			log.WithField("template-out", f.Name()).Debug("created new output file for template")
@@ -37,21 +92,105 @@ var rootCmd = &cobra.Command{
 			if _, err := os.Stat(rootCmdFlags.tmplOut); err == nil {
 				if !rootCmdFlags.tmplOverwrite {
 					log.WithField("template-out", rootCmdFlags.tmplOut).Error("File already exists")
-					os.Exit(-1)
+					os.Exit(errorExitCode)
 				}
 			}
 		}
 	},
 }
 
+// readStackConfig reads the stack config file or the stack config of the
+// environment in the environments directory, if any. The stack name and the
+// parameters written as `Key=Value`, if any, override those in the stack
+// config.
+func readStackConfig(stackConfigFile, envDir, env, stackName string, parameters []string) (*cform.StackConfig, error) {
+	if env != "" {
+		if stackConfigFile != "" {
+			err := errors.New("stack config and environment cannot be used together")
+			log.Error(err)
+			return nil, err
+		}
+
+		var err error
+		if stackConfigFile, err = cform.FindEnvStackConfig(envDir, env); err != nil {
+			log.WithError(err).Error("cannot find stack config of environment")
+			return nil, err
+		}
+		log.WithField("stack-config", stackConfigFile).Debug("using stack config of environment")
+	}
+
+	cfg := &cform.StackConfig{}
+	if stackConfigFile != "" {
+		var err error
+		if cfg, err = cform.ReadStackConfig(stackConfigFile); err != nil {
+			log.WithError(err).Error("cannot read stack config")
+			return nil, err
+		}
+	}
+
+	overrides, err := cform.ParseParameterOverrides(parameters)
+	if err != nil {
+		log.WithError(err).Error("invalid parameter")
+		return nil, err
+	}
+	cfg.OverrideParameters(overrides)
+
+	if stackName != "" {
+		cfg.StackName = stackName
+	}
+	if cfg.StackName == "" {
+		err := errors.New("stack name is neither passed nor defined in the stack config")
+		log.Error(err)
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// stackInput returns the template body, the parameters and the capabilities
+// passed to the stack operations.
+func stackInput(tmpl *cform.Template, cfg *cform.StackConfig) (*cform.StackInput, error) {
+	body, err := templateBody(tmpl)
+	if err != nil {
+		log.WithError(err).Error("cannot generate template body")
+		return nil, err
+	}
+
+	params, err := cfg.ResolveParameters(tmpl.Parameters())
+	if err != nil {
+		log.WithError(err).Error("cannot resolve parameters")
+		return nil, err
+	}
+
+	caps, err := cfg.ResolveCapabilities(tmpl.Capabilities())
+	if err != nil {
+		log.WithError(err).Error("cannot acknowledge capabilities")
+		return nil, err
+	}
+	log.WithField("capabilities", caps).Debug("acknowledging capabilities")
+
+	return &cform.StackInput{TemplateBody: body, Parameters: params, Capabilities: caps, IncludeNestedStacks: tmpl.HasNestedStacks()}, nil
+}
+
+// isTerminal checks if the file is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
 func main() {
 	rootCmd.PersistentFlags().BoolVar(&rootCmdFlags.debug, "debug", false, "Print debug information")
 	rootCmd.PersistentFlags().StringVar(&rootCmdFlags.tmplOut, "template-out", "", "Location to which the merged template will be written")
 	rootCmd.PersistentFlags().StringVar(&rootCmdFlags.tmplSrc, "template-src", "templates", "Directory containing CloudFormation templates")
 	rootCmd.PersistentFlags().BoolVar(&rootCmdFlags.tmplOverwrite, "template-overwrite", false, "Overwrite existing template output file")
+	rootCmd.PersistentFlags().StringVar(&rootCmdFlags.outputFormat, "output-format", "yaml", "Format of the merged template (yaml or json)")
+	rootCmd.PersistentFlags().StringVar(&rootCmdFlags.intrinsicForm, "intrinsic-form", "long", "Form of the intrinsic functions in the merged template (long or short)")
+	rootCmd.PersistentFlags().StringSliceVar(&rootCmdFlags.include, "include", nil, "Glob patterns of the template files to merge; all files are merged by default")
+	rootCmd.PersistentFlags().StringSliceVar(&rootCmdFlags.exclude, "exclude", nil, "Glob patterns of the template files and directories to skip")
+	rootCmd.PersistentFlags().BoolVar(&rootCmdFlags.allowOverride, "allow-override", false, "Allow templates to override entries with the same name defined in other templates")
+	rootCmd.PersistentFlags().BoolVar(&rootCmdFlags.annotate, "annotate-sources", false, "Add the source file and line of each resource to its cform:Source metadata")
 
 	if err := rootCmd.Execute(); err != nil {
 		log.WithError(err).Error("Failed to initialize cform ctl")
-		os.Exit(-1)
+		os.Exit(errorExitCode)
 	}
 }
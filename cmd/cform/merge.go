@@ -1,10 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/isubuz/cform"
@@ -15,34 +16,72 @@ var mergeCmd = &cobra.Command{
 	Use:   "merge",
 	Short: "Merge CloudFormation templates",
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := mergeFromDir(rootCmdFlags.tmplSrc, rootCmdFlags.tmplOut); err != nil {
+		if _, err := mergeFromDir(rootCmdFlags.tmplSrc, rootCmdFlags.tmplOut, readerOpts, mergeOpts); err != nil {
 			os.Exit(-1)
 		}
 	},
 }
 
-func mergeFromDir(tmplSrc, tmplOut string) error {
-	dirReader, err := cform.NewDirectoryReader(tmplSrc)
+// mergeFromDir merges the templates in the source directory, writes the
+// merged template to the output file and returns the merged template.
+func mergeFromDir(tmplSrc, tmplOut string, readerOpts cform.DirectoryReaderOptions, opts cform.MergeOptions) (*cform.Template, error) {
+	dirReader, err := cform.NewDirectoryReader(tmplSrc, readerOpts)
 	if err != nil {
 		log.WithError(err).Error("Could not create directory reader")
-		return err
+		return nil, err
 	}
 
-	yaml := []byte(fmt.Sprintf("# THIS FILE HAS BEEN GENERATED AUTOMATICALLY BY cform AT %s.\n# DO NOT MODIFY THIS FILE MANUALLY.\n\n", time.Now()))
+	tmpl, err := cform.ReadTemplates(dirReader, opts)
+	if err != nil {
+		log.WithError(err).Error("Could not merge template files")
+		return nil, err
+	}
 
-	merged, err := cform.MergeTemplates(dirReader)
+	merged, err := tmpl.Marshal(opts.Format, opts.IntrinsicForm)
 	if err != nil {
-		log.WithError(err).Error("Could not merge yaml files")
-		return err
+		log.WithError(err).Error("Could not generate merged template")
+		return nil, err
 	}
 
-	yaml = append(yaml, merged...)
+	var out []byte
+	if opts.Format == cform.YAML {
+		// The header contains a checksum of the merged template instead of a
+		// timestamp so that merging the same templates always generates the
+		// same file. JSON does not support comments and hence has no header.
+		out = []byte(fmt.Sprintf("# THIS FILE HAS BEEN GENERATED AUTOMATICALLY BY cform (SHA-256 %s).\n# DO NOT MODIFY THIS FILE MANUALLY.\n\n", cform.Checksum(merged)))
+	}
+	out = append(out, merged...)
 
-	if err = ioutil.WriteFile(tmplOut, yaml, 0644); err != nil {
+	if err = ioutil.WriteFile(tmplOut, out, 0644); err != nil {
 		log.WithField("template-out", tmplOut).Error("Could not write to output file")
-		return err
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// templateBody returns the body of the template sent to CloudFormation which
+// is the smaller of its YAML and compact JSON representations.
+func templateBody(tmpl *cform.Template) (string, error) {
+	y, err := tmpl.Marshal(cform.YAML, mergeOpts.IntrinsicForm)
+	if err != nil {
+		return "", err
+	}
+
+	j, err := tmpl.Marshal(cform.JSON, cform.LongForm)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, j); err != nil {
+		return "", err
+	}
+
+	if buf.Len() < len(y) {
+		log.WithField("template-size", buf.Len()).Debug("using JSON template body")
+		return buf.String(), nil
 	}
-	return nil
+	log.WithField("template-size", len(y)).Debug("using YAML template body")
+	return string(y), nil
 }
 
 func init() {
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/fatih/color"
+	"github.com/isubuz/cform"
+)
+
+// Formats in which a plan is written
+const (
+	// Colored text for terminals
+	textFormat = "text"
+	// JSON document for policy checks and other tools
+	jsonFormat = "json"
+	// Markdown document for pull request comments
+	markdownFormat = "markdown"
+)
+
+// checkPlanFormat checks if the plan can be written in the format.
+func checkPlanFormat(format string) error {
+	switch format {
+	case textFormat, jsonFormat, markdownFormat:
+		return nil
+	}
+	return fmt.Errorf("Unknown plan format %s; must be one of text, json or markdown", format)
+}
+
+// planOutput is the JSON representation of a plan. It contains the fields of
+// the plan saved using `plan --out` along with the summary of the changes and
+// the capabilities required by the template.
+type planOutput struct {
+	*cform.Plan
+	Summary              cform.PlanSummary
+	RequiredCapabilities []cform.RequiredCapability `json:",omitempty"`
+}
+
+// writePlan writes the plan in the format along with the capabilities
+// required by the template, if known.
+func writePlan(w io.Writer, format string, p *cform.Plan, caps []cform.RequiredCapability) error {
+	switch format {
+	case jsonFormat:
+		return writeJSONPlan(w, p, caps)
+	case markdownFormat:
+		return writeMarkdownPlan(w, p, caps)
+	}
+	return writeTextPlan(w, p, caps)
+}
+
+// writeNoChanges writes in the format that the stack is up to date.
+func writeNoChanges(w io.Writer, format string, stackName string) error {
+	switch format {
+	case jsonFormat:
+		return writeJSONPlan(w, &cform.Plan{Version: cform.PlanVersion, StackName: stackName}, nil)
+	case markdownFormat:
+		_, err := fmt.Fprintf(w, "### Plan for stack `%s`\n\nNo changes. The stack is up to date.\n", stackName)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "No changes. Stack %s is up to date.\n", stackName)
+	return err
+}
+
+// writeJSONPlan writes the plan as an indented JSON document.
+func writeJSONPlan(w io.Writer, p *cform.Plan, caps []cform.RequiredCapability) error {
+	b, err := json.MarshalIndent(planOutput{Plan: p, Summary: p.Summary(), RequiredCapabilities: caps}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// writeTextPlan writes the capabilities and the changes to any new or
+// existing resources along with the location of the resources in the template
+// sources. The resources are colored by their action unless color is
+// disabled. The changes to the resources of nested stacks are written below
+// the nested stacks. Changes which may lose data are highlighted in bold red
+// and are listed again as a warning above the summary.
+func writeTextPlan(w io.Writer, p *cform.Plan, caps []cform.RequiredCapability) error {
+	if p.ChangeSetType == cloudformation.ChangeSetTypeCreate {
+		fmt.Fprintf(w, "Stack %s does not exist and will be created\n\n", p.StackName)
+	}
+
+	if len(caps) > 0 {
+		fmt.Fprintln(w, "Capabilities")
+		for _, c := range caps {
+			fmt.Fprintf(w, "\t%-22s: %s\n", c.Name, strings.Join(c.Reasons, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+
+	if err := writeTextChanges(w, p.Changes, ""); err != nil {
+		return err
+	}
+
+	if risky := p.RiskyChanges(); len(risky) > 0 {
+		warn := color.New(color.FgRed, color.Bold)
+		warn.Fprintln(w, "Warning: the following changes may lose data")
+		for _, c := range risky {
+			warn.Fprintf(w, "\t%-8s %s (%s): %s\n", c.Risk, c.LogicalResourceID, c.ResourceType, c.RiskReason)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "Plan: %s\n", p.Summary())
+	return nil
+}
+
+// writeTextChanges writes the changes to the resources, each line prefixed by
+// the indent. The changes to the resources of a nested stack are written
+// below the change to the nested stack along with their summary and are
+// indented further.
+func writeTextChanges(w io.Writer, changes []cform.PlanChange, indent string) error {
+	for _, change := range changes {
+		var c color.Attribute
+		if change.Action == "Add" {
+			c = color.FgGreen
+		} else if change.Action == "Modify" {
+			c = color.FgYellow
+		} else if change.Action == "Remove" {
+			c = color.FgRed
+		} else {
+			return fmt.Errorf("Unknown action: %s", change.Action)
+		}
+		cPrint := color.New(c)
+		if change.Risk != "" {
+			cPrint = color.New(color.FgRed, color.Bold)
+		}
+		cPrint.Fprintf(w, "%s%s (%s)\n", indent, change.LogicalResourceID, change.ResourceType)
+
+		fmt.Fprintf(w, "%s\t%-15s: %s\n", indent, "action", change.Action)
+		fmt.Fprintf(w, "%s\t%-15s: %s\n", indent, "physical-id", orNA(change.PhysicalResourceID))
+		fmt.Fprintf(w, "%s\t%-15s: %s\n", indent, "replacement", orNA(change.Replacement))
+		if len(change.Scope) > 0 {
+			fmt.Fprintf(w, "%s\t%-15s: %s\n", indent, "scope", strings.Join(change.Scope, ", "))
+		}
+		if change.Source != "" || indent == "" {
+			fmt.Fprintf(w, "%s\t%-15s: %s\n", indent, "source", orNA(change.Source))
+		}
+		if change.Risk != "" {
+			cPrint.Fprintf(w, "%s\t%-15s: %s (%s)\n", indent, "risk", change.Risk, change.RiskReason)
+		}
+		writeTextChangeDetails(w, change.Details, indent)
+		if change.ChangeSetID != "" {
+			fmt.Fprintf(w, "%s\t%-15s: %s\n", indent, "nested-changes", cform.SummarizeChanges(change.NestedChanges))
+		}
+		fmt.Fprintln(w)
+
+		if err := writeTextChanges(w, change.NestedChanges, indent+"    "); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTextChangeDetails writes the changes to the attributes of a resource
+// and the reasons why they change. Changes which always require the resource
+// to be recreated are highlighted in red and those which may require it in
+// yellow. The new values of dynamic changes are only known once the change set
+// is executed and hence are written as `<known after apply>`. Each line is
+// prefixed by the indent.
+func writeTextChangeDetails(w io.Writer, details []cform.PlanChangeDetail, indent string) {
+	if len(details) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "%s\t%-15s:\n", indent, "details")
+	for _, d := range details {
+		var reasons []string
+		for _, r := range []struct{ name, value string }{
+			{"requires-recreation", d.RequiresRecreation},
+			{"evaluation", d.Evaluation},
+			{"change-source", d.ChangeSource},
+			{"caused-by", d.CausingEntity},
+		} {
+			if r.value != "" {
+				reasons = append(reasons, r.name+"="+r.value)
+			}
+		}
+
+		line := fmt.Sprintf("%s\t\t%s %s\n", indent, detailTarget(d), strings.Join(reasons, " "))
+		switch d.RequiresRecreation {
+		case cloudformation.RequiresRecreationAlways:
+			color.New(color.FgRed).Fprint(w, line)
+		case cloudformation.RequiresRecreationConditionally:
+			color.New(color.FgYellow).Fprint(w, line)
+		default:
+			fmt.Fprint(w, line)
+		}
+
+		if d.OldValue != "" || d.NewValue != "" {
+			color.New(color.FgRed).Fprintf(w, "%s\t\t\t- %s\n", indent, orNA(d.OldValue))
+			color.New(color.FgGreen).Fprintf(w, "%s\t\t\t+ %s\n", indent, detailNewValue(d))
+		}
+	}
+}
+
+// writeMarkdownPlan writes the plan as a Markdown document which is suitable
+// for pull request comments. The changes are summarised in a table followed
+// by the details of each modified resource.
+func writeMarkdownPlan(w io.Writer, p *cform.Plan, caps []cform.RequiredCapability) error {
+	fmt.Fprintf(w, "### Plan for stack `%s`\n\n", p.StackName)
+	if p.ChangeSetType == cloudformation.ChangeSetTypeCreate {
+		fmt.Fprintf(w, "The stack does not exist and will be created.\n\n")
+	}
+	fmt.Fprintf(w, "**Plan:** %s\n\n", p.Summary())
+
+	if risky := p.RiskyChanges(); len(risky) > 0 {
+		fmt.Fprintf(w, "> **Warning:** the following changes may lose data\n>\n")
+		for _, c := range risky {
+			fmt.Fprintf(w, "> - **%s** `%s` (%s): %s\n", c.Risk, c.LogicalResourceID, c.ResourceType, c.RiskReason)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(caps) > 0 {
+		fmt.Fprintf(w, "Capabilities:\n\n")
+		for _, c := range caps {
+			fmt.Fprintf(w, "- `%s`: %s\n", c.Name, strings.Join(c.Reasons, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(p.Changes) == 0 {
+		return nil
+	}
+	writeMarkdownChanges(w, p.Changes, "")
+	return nil
+}
+
+// writeMarkdownChanges writes a table of the changes followed by the details
+// of each modified resource and a section for each changed nested stack. The
+// prefix qualifies the logical IDs of the resources of nested stacks.
+func writeMarkdownChanges(w io.Writer, changes []cform.PlanChange, prefix string) {
+	fmt.Fprintln(w, "| Action | Resource | Type | Physical ID | Replacement | Source |")
+	fmt.Fprintln(w, "| --- | --- | --- | --- | --- | --- |")
+	for _, c := range changes {
+		fmt.Fprintf(w, "| %s | `%s` | `%s` | %s | %s | %s |\n", c.Action, prefix+c.LogicalResourceID, c.ResourceType,
+			markdownCell(c.PhysicalResourceID), markdownCell(c.Replacement), markdownCell(c.Source))
+	}
+
+	for _, c := range changes {
+		if len(c.Details) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "\n#### `%s` (%s)\n\n", prefix+c.LogicalResourceID, c.ResourceType)
+		for _, d := range c.Details {
+			fmt.Fprintf(w, "- `%s`: requires recreation **%s**", detailTarget(d), orNA(d.RequiresRecreation))
+			if d.Evaluation != "" || d.ChangeSource != "" {
+				reason := strings.TrimSpace(d.Evaluation + " " + d.ChangeSource)
+				if d.CausingEntity != "" {
+					reason += " caused by `" + d.CausingEntity + "`"
+				}
+				fmt.Fprintf(w, " (%s)", reason)
+			}
+			fmt.Fprintln(w)
+
+			if d.OldValue != "" || d.NewValue != "" {
+				fmt.Fprintf(w, "  ```diff\n  - %s\n  + %s\n  ```\n", orNA(d.OldValue), detailNewValue(d))
+			}
+		}
+	}
+
+	for _, c := range changes {
+		if c.ChangeSetID == "" {
+			continue
+		}
+
+		nested := prefix + c.LogicalResourceID
+		fmt.Fprintf(w, "\n#### Nested stack `%s`\n\n**Plan:** %s\n\n", nested, cform.SummarizeChanges(c.NestedChanges))
+		if len(c.NestedChanges) > 0 {
+			writeMarkdownChanges(w, c.NestedChanges, nested+"/")
+		}
+	}
+}
+
+// detailTarget returns the name of the attribute, or the property, changed by
+// a change to a resource.
+func detailTarget(d cform.PlanChangeDetail) string {
+	if d.Name != "" {
+		return d.Attribute + "." + d.Name
+	}
+	return d.Attribute
+}
+
+// detailNewValue returns the new value of the changed attribute or
+// `<known after apply>` if the change is dynamic, i.e. the new value is only
+// evaluated when the change set is executed, e.g. when it refers to an
+// attribute of another resource which changes.
+func detailNewValue(d cform.PlanChangeDetail) string {
+	if d.Evaluation == cloudformation.EvaluationTypeDynamic {
+		return "<known after apply>"
+	}
+	return orNA(d.NewValue)
+}
+
+// markdownCell returns the value escaped for a Markdown table cell or a dash
+// if it is empty.
+func markdownCell(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Replace(s, "|", "\\|", -1)
+}
+
+// orNA returns the input string or `<NA>` if it is empty.
+func orNA(s string) string {
+	if s == "" {
+		return "<NA>"
+	}
+	return s
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/isubuz/cform"
+)
+
+func newOutputPlan() *cform.Plan {
+	return &cform.Plan{
+		Version:       cform.PlanVersion,
+		StackName:     "test-stack",
+		StackID:       "test-stack-id",
+		ChangeSetID:   "testcs-id",
+		ChangeSetName: "testcs",
+		ChangeSetType: "UPDATE",
+		Changes: []cform.PlanChange{
+			{
+				Action:             "Modify",
+				LogicalResourceID:  "Bucket",
+				PhysicalResourceID: "b1.isubuz.com",
+				ResourceType:       "AWS::S3::Bucket",
+				Replacement:        "True",
+				Scope:              []string{"Properties"},
+				Source:             "storage.yml:2",
+				Risk:               cform.RiskReplace,
+				RiskReason:         "stateful resource is replaced without a retaining UpdateReplacePolicy",
+				Details: []cform.PlanChangeDetail{{
+					Attribute:          "Properties",
+					Name:               "BucketName",
+					RequiresRecreation: "Always",
+					Evaluation:         "Static",
+					ChangeSource:       "DirectModification",
+					OldValue:           `"b1.isubuz.com"`,
+					NewValue:           `"b2.isubuz.com"`,
+				}},
+			},
+			{Action: "Add", LogicalResourceID: "Queue", ResourceType: "AWS::SQS::Queue", Source: "queue.yml:1"},
+		},
+	}
+}
+
+func TestWriteTextPlan(t *testing.T) {
+	defer func(noColor bool) { color.NoColor = noColor }(color.NoColor)
+	color.NoColor = true
+
+	var buf bytes.Buffer
+	caps := []cform.RequiredCapability{{Name: "CAPABILITY_IAM", Reasons: []string{"Role (AWS::IAM::Role)"}}}
+	if err := writePlan(&buf, textFormat, newOutputPlan(), caps); err != nil {
+		t.Fatalf("Unexpected error (%s)", err)
+	}
+
+	expected := strings.Join([]string{
+		"Capabilities",
+		"\tCAPABILITY_IAM        : Role (AWS::IAM::Role)",
+		"",
+		"Bucket (AWS::S3::Bucket)",
+		"\taction         : Modify",
+		"\tphysical-id    : b1.isubuz.com",
+		"\treplacement    : True",
+		"\tscope          : Properties",
+		"\tsource         : storage.yml:2",
+		"\trisk           : Replace (stateful resource is replaced without a retaining UpdateReplacePolicy)",
+		"\tdetails        :",
+		"\t\tProperties.BucketName requires-recreation=Always evaluation=Static change-source=DirectModification",
+		"\t\t\t- \"b1.isubuz.com\"",
+		"\t\t\t+ \"b2.isubuz.com\"",
+		"",
+		"Queue (AWS::SQS::Queue)",
+		"\taction         : Add",
+		"\tphysical-id    : <NA>",
+		"\treplacement    : <NA>",
+		"\tsource         : queue.yml:1",
+		"",
+		"Warning: the following changes may lose data",
+		"\tReplace  Bucket (AWS::S3::Bucket): stateful resource is replaced without a retaining UpdateReplacePolicy",
+		"",
+		"Plan: 1 to add, 1 to change (1 replacement), 0 to destroy",
+		"",
+	}, "\n")
+	if buf.String() != expected {
+		t.Errorf("Expected (%s), Found (%s)", expected, buf.String())
+	}
+}
+
+func TestWriteMarkdownPlan(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writePlan(&buf, markdownFormat, newOutputPlan(), nil); err != nil {
+		t.Fatalf("Unexpected error (%s)", err)
+	}
+
+	expected := strings.Join([]string{
+		"### Plan for stack `test-stack`",
+		"",
+		"**Plan:** 1 to add, 1 to change (1 replacement), 0 to destroy",
+		"",
+		"> **Warning:** the following changes may lose data",
+		">",
+		"> - **Replace** `Bucket` (AWS::S3::Bucket): stateful resource is replaced without a retaining UpdateReplacePolicy",
+		"",
+		"| Action | Resource | Type | Physical ID | Replacement | Source |",
+		"| --- | --- | --- | --- | --- | --- |",
+		"| Modify | `Bucket` | `AWS::S3::Bucket` | b1.isubuz.com | True | storage.yml:2 |",
+		"| Add | `Queue` | `AWS::SQS::Queue` | - | - | queue.yml:1 |",
+		"",
+		"#### `Bucket` (AWS::S3::Bucket)",
+		"",
+		"- `Properties.BucketName`: requires recreation **Always** (Static DirectModification)",
+		"  ```diff",
+		`  - "b1.isubuz.com"`,
+		`  + "b2.isubuz.com"`,
+		"  ```",
+		"",
+	}, "\n")
+	if buf.String() != expected {
+		t.Errorf("Expected (%s), Found (%s)", expected, buf.String())
+	}
+}
+
+func TestWriteJSONPlan(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writePlan(&buf, jsonFormat, newOutputPlan(), nil); err != nil {
+		t.Fatalf("Unexpected error (%s)", err)
+	}
+
+	var found struct {
+		StackName string
+		Summary   cform.PlanSummary
+		Changes   []cform.PlanChange
+	}
+	if err := json.Unmarshal(buf.Bytes(), &found); err != nil {
+		t.Fatalf("Invalid JSON plan: %s", err)
+	}
+	expected := cform.PlanSummary{Add: 1, Modify: 1, Replace: 1}
+	if found.StackName != "test-stack" || found.Summary != expected || len(found.Changes) != 2 {
+		t.Errorf("Expected (test-stack %v 2 changes), Found (%s)", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := writeNoChanges(&buf, jsonFormat, "test-stack"); err != nil {
+		t.Fatalf("Unexpected error (%s)", err)
+	}
+	if !strings.Contains(buf.String(), `"Summary": {`) || strings.Contains(buf.String(), `"Changes"`) {
+		t.Errorf("Expected plan without changes, Found (%s)", buf.String())
+	}
+
+	if err := checkPlanFormat("html"); err == nil {
+		t.Errorf("Expected error for unknown plan format")
+	}
+}
+
+func TestWriteNestedPlan(t *testing.T) {
+	defer func(noColor bool) { color.NoColor = noColor }(color.NoColor)
+	color.NoColor = true
+
+	p := &cform.Plan{
+		Version:       cform.PlanVersion,
+		StackName:     "test-stack",
+		ChangeSetType: "UPDATE",
+		Changes: []cform.PlanChange{{
+			Action:             "Modify",
+			LogicalResourceID:  "Network",
+			PhysicalResourceID: "network-id",
+			ResourceType:       "AWS::CloudFormation::Stack",
+			Replacement:        "False",
+			Source:             "network.yml:1",
+			ChangeSetID:        "network-cs",
+			NestedChanges: []cform.PlanChange{
+				{Action: "Add", LogicalResourceID: "Subnet", ResourceType: "AWS::EC2::Subnet"},
+				{Action: "Remove", LogicalResourceID: "Gateway", PhysicalResourceID: "igw-1", ResourceType: "AWS::EC2::InternetGateway",
+					Risk: cform.RiskDestroy, RiskReason: "resource is removed without a retaining DeletionPolicy"},
+			},
+		}},
+	}
+
+	var buf bytes.Buffer
+	if err := writePlan(&buf, textFormat, p, nil); err != nil {
+		t.Fatalf("Unexpected error (%s)", err)
+	}
+	expected := strings.Join([]string{
+		"Network (AWS::CloudFormation::Stack)",
+		"\taction         : Modify",
+		"\tphysical-id    : network-id",
+		"\treplacement    : False",
+		"\tsource         : network.yml:1",
+		"\tnested-changes : 1 to add, 0 to change, 1 to destroy",
+		"",
+		"    Subnet (AWS::EC2::Subnet)",
+		"    \taction         : Add",
+		"    \tphysical-id    : <NA>",
+		"    \treplacement    : <NA>",
+		"",
+		"    Gateway (AWS::EC2::InternetGateway)",
+		"    \taction         : Remove",
+		"    \tphysical-id    : igw-1",
+		"    \treplacement    : <NA>",
+		"    \trisk           : Destroy (resource is removed without a retaining DeletionPolicy)",
+		"",
+		"Warning: the following changes may lose data",
+		"\tDestroy  Network/Gateway (AWS::EC2::InternetGateway): resource is removed without a retaining DeletionPolicy",
+		"",
+		"Plan: 1 to add, 1 to change, 1 to destroy",
+		"",
+	}, "\n")
+	if buf.String() != expected {
+		t.Errorf("Expected (%s), Found (%s)", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := writePlan(&buf, markdownFormat, p, nil); err != nil {
+		t.Fatalf("Unexpected error (%s)", err)
+	}
+	expected = strings.Join([]string{
+		"### Plan for stack `test-stack`",
+		"",
+		"**Plan:** 1 to add, 1 to change, 1 to destroy",
+		"",
+		"> **Warning:** the following changes may lose data",
+		">",
+		"> - **Destroy** `Network/Gateway` (AWS::EC2::InternetGateway): resource is removed without a retaining DeletionPolicy",
+		"",
+		"| Action | Resource | Type | Physical ID | Replacement | Source |",
+		"| --- | --- | --- | --- | --- | --- |",
+		"| Modify | `Network` | `AWS::CloudFormation::Stack` | network-id | False | network.yml:1 |",
+		"",
+		"#### Nested stack `Network`",
+		"",
+		"**Plan:** 1 to add, 0 to change, 1 to destroy",
+		"",
+		"| Action | Resource | Type | Physical ID | Replacement | Source |",
+		"| --- | --- | --- | --- | --- | --- |",
+		"| Add | `Network/Subnet` | `AWS::EC2::Subnet` | - | - | - |",
+		"| Remove | `Network/Gateway` | `AWS::EC2::InternetGateway` | igw-1 | - | - |",
+		"",
+	}, "\n")
+	if buf.String() != expected {
+		t.Errorf("Expected (%s), Found (%s)", expected, buf.String())
+	}
+}
+
+func TestWriteDynamicChangeDetails(t *testing.T) {
+	defer func(noColor bool) { color.NoColor = noColor }(color.NoColor)
+	color.NoColor = true
+
+	changes := []cform.PlanChange{{
+		Action:            "Modify",
+		LogicalResourceID: "Logs",
+		ResourceType:      "AWS::S3::Bucket",
+		Replacement:       "Conditional",
+		Details: []cform.PlanChangeDetail{{
+			Attribute:          "Properties",
+			Name:               "BucketName",
+			RequiresRecreation: "Always",
+			Evaluation:         "Dynamic",
+			ChangeSource:       "ResourceReference",
+			CausingEntity:      "Bucket",
+			OldValue:           `{"Fn::Sub":"${Bucket}-logs"}`,
+			NewValue:           `{"Fn::Sub":"${Bucket}-logs"}`,
+		}},
+	}}
+
+	var buf bytes.Buffer
+	writeTextChangeDetails(&buf, changes[0].Details, "")
+	expected := strings.Join([]string{
+		"\tdetails        :",
+		"\t\tProperties.BucketName requires-recreation=Always evaluation=Dynamic change-source=ResourceReference caused-by=Bucket",
+		`			- {"Fn::Sub":"${Bucket}-logs"}`,
+		"\t\t\t+ <known after apply>",
+		"",
+	}, "\n")
+	if buf.String() != expected {
+		t.Errorf("Expected (%s), Found (%s)", expected, buf.String())
+	}
+
+	buf.Reset()
+	writeMarkdownChanges(&buf, changes, "")
+	if !strings.Contains(buf.String(), "  ```diff\n  - {\"Fn::Sub\":\"${Bucket}-logs\"}\n  + <known after apply>\n  ```\n") {
+		t.Errorf("Expected new value known after apply, Found (%s)", buf.String())
+	}
+}
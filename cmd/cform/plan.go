@@ -1,14 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"math/rand"
 	"os"
+	"os/signal"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/fatih/color"
 	"github.com/isubuz/cform"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -27,6 +29,17 @@ var planCmdFlags struct {
 	// CLI command.
 	stackConfigFile string
 
+	// Name of the environment whose stack config is read from the
+	// environments directory instead of the stack config file
+	env string
+
+	// Directory containing the stack configs of the environments
+	envDir string
+
+	// Parameter values written as `Key=Value` which override the values in
+	// the stack config
+	parameters []string
+
 	// The name of the temporary change set to be created which is used to
 	// determine the execution plan. By default a random timestamped name is
 	// generated.
@@ -35,161 +48,469 @@ var planCmdFlags struct {
 	// If true, the change set created to determine the execution plan will be
 	// retained.
 	keepChangeSet bool
+
+	// File to which the plan is saved so that it can be executed by the
+	// `apply` command. The change set is retained if the plan is saved.
+	out string
+
+	// Format in which the plan is written: text, json or markdown
+	format string
+
+	// If true, the exit code is 0 if there are no changes, 1 on errors and 2
+	// if there are changes.
+	detailedExitCode bool
+
+	// Maximum time to wait for the change set to be created
+	changeSetTimeout time.Duration
 }
 
 var planCmd = &cobra.Command{
 	Use:   "plan",
 	Short: "Show execution plan",
 	PreRun: func(cmd *cobra.Command, args []string) {
+		if err := checkPlanFormat(planCmdFlags.format); err != nil {
+			log.WithError(err).Error("invalid plan format")
+			os.Exit(errorExitCode)
+		}
+
+		changeSetWait.timeout = planCmdFlags.changeSetTimeout
+
 		// Set random change set name if not passed
 		if planCmdFlags.changeSetName == "" {
-			t := time.Now()
-			planCmdFlags.changeSetName = fmt.Sprintf("cs-%s", t.Format("20060102150405"))
-			log.WithField("change-set-name", planCmdFlags.changeSetName).Debug("generating new change set name")
+			planCmdFlags.changeSetName = newChangeSetName()
 		}
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		// TODO Check if stack exists
-		if err := mergeFromDir(rootCmdFlags.tmplSrc, rootCmdFlags.tmplOut); err != nil {
-			os.Exit(-1)
+		cfg, err := readStackConfig(planCmdFlags.stackConfigFile, planCmdFlags.envDir, planCmdFlags.env, planCmdFlags.stackName,
+			planCmdFlags.parameters)
+		if err != nil {
+			os.Exit(errorExitCode)
 		}
 
-		tmpl, err := ioutil.ReadFile(rootCmdFlags.tmplOut)
+		tmpl, err := mergeFromDir(rootCmdFlags.tmplSrc, rootCmdFlags.tmplOut, readerOpts, mergeOpts)
 		if err != nil {
-			log.WithError(err).Error("cannot read merged template file")
-			os.Exit(-1)
+			os.Exit(errorExitCode)
 		}
 
 		sess, err := session.NewSession()
 		if err != nil {
 			log.WithError(err).Error("failed to create session")
-			os.Exit(-1)
+			os.Exit(errorExitCode)
 		}
 
 		svc := cloudformation.New(sess)
-		if err := plan(svc, string(tmpl), planCmdFlags.stackConfigFile, planCmdFlags.stackName,
-			planCmdFlags.changeSetName, planCmdFlags.keepChangeSet); err != nil {
-			os.Exit(-1)
+		p, err := plan(svc, tmpl, cfg, planCmdFlags.changeSetName, planCmdFlags.keepChangeSet, planCmdFlags.out)
+		if err == errNoChanges {
+			if err := writeNoChanges(os.Stdout, planCmdFlags.format, cfg.StackName); err != nil {
+				log.WithError(err).Error("cannot write plan")
+				os.Exit(errorExitCode)
+			}
+			return
+		}
+		if err != nil {
+			os.Exit(errorExitCode)
+		}
+
+		if err := writePlan(os.Stdout, planCmdFlags.format, p, tmpl.Capabilities()); err != nil {
+			log.WithError(err).Error("cannot write plan")
+			os.Exit(errorExitCode)
+		}
+
+		if planCmdFlags.out != "" {
+			// Written to stderr to keep the plan on stdout machine-readable
+			fmt.Fprintf(os.Stderr, "Saved plan to %s. Run `cform apply %s` to execute exactly this plan.\n", planCmdFlags.out, planCmdFlags.out)
+		}
+
+		if planCmdFlags.detailedExitCode {
+			os.Exit(2)
 		}
 	},
 }
 
-// plan creates a new change set using the input template and returns the
-// execution plan based on information retrieved from the change set.
-func plan(svc cloudformationiface.CloudFormationAPI, tmpl, stackConfigFile, stackName, changeSetName string, keepChangeSet bool) error {
-	changeSetCreated := false
-	defer func() {
-		if changeSetCreated && !keepChangeSet {
-			// Delete the change set
-			delInput := &cloudformation.DeleteChangeSetInput{
-				ChangeSetName: aws.String(changeSetName),
-				StackName:     aws.String(stackName),
-			}
-			if _, err := svc.DeleteChangeSet(delInput); err != nil {
-				log.WithField("change-set-name", changeSetName).Error("cannot delete change set")
-			} else {
-				log.WithField("change-set-name", changeSetName).Debug("deleted change set")
-			}
+// errNoChanges is returned if the change set cannot be created because the
+// template and the stack config do not change the stack.
+var errNoChanges = errors.New("change set does not contain changes")
+
+// newChangeSetName returns a random timestamped change set name.
+func newChangeSetName() string {
+	name := fmt.Sprintf("cs-%s", time.Now().Format("20060102150405"))
+	log.WithField("change-set-name", name).Debug("generating new change set name")
+	return name
+}
+
+// plan creates a new change set using the input template and stack config and
+// returns the execution plan based on information retrieved from the change
+// set. The plan is saved to the out file, if any, in which case the change set
+// is retained. Otherwise the change set is deleted unless it is retained.
+//
+// If the change set does not contain changes or the wait for it is
+// interrupted, it is always deleted and errNoChanges or errInterrupted is
+// returned.
+func plan(svc cloudformationiface.CloudFormationAPI, tmpl *cform.Template, cfg *cform.StackConfig, changeSetName string, keepChangeSet bool,
+	out string) (*cform.Plan, error) {
+	p, discard, err := createPlan(svc, tmpl, cfg, changeSetName)
+	if err == nil && out != "" {
+		if err = p.Write(out); err != nil {
+			log.WithError(err).Error("cannot save plan")
 		}
-	}()
+	}
+	keepChangeSet = keepChangeSet || out != ""
+	if discard != nil && (!keepChangeSet || err == errNoChanges || err == errInterrupted) {
+		defer discard()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
 
-	// Create the change set
-	createInput := &cloudformation.CreateChangeSetInput{
-		ChangeSetName: aws.String(changeSetName),
-		StackName:     aws.String(stackName),
-		TemplateBody:  aws.String(tmpl),
+// createPlan creates a new change set using the input template and stack
+// config and returns the plan based on information retrieved from the change
+// set. The source map of the template is used to find the source of each
+// resource. Once the change set is created, a function which deletes it is
+// returned even if the plan cannot be determined.
+//
+// A `CREATE` change set is used if the stack does not exist, in which case
+// CloudFormation creates the stack in the `REVIEW_IN_PROGRESS` state to hold
+// the change set. The stack is deleted instead of the change set.
+func createPlan(svc cloudformationiface.CloudFormationAPI, tmpl *cform.Template, cfg *cform.StackConfig, changeSetName string) (*cform.Plan, func(), error) {
+	stackName := cfg.StackName
+
+	in, err := stackInput(tmpl, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	policy, err := cfg.StackPolicyBody()
+	if err != nil {
+		log.WithError(err).Error("invalid stack config")
+		return nil, nil, err
 	}
 
-	createResp, err := svc.CreateChangeSet(createInput)
+	stack, err := cform.DescribeStack(svc, stackName)
+	if err != nil {
+		log.WithError(err).Error("cannot retrieve stack")
+		return nil, nil, err
+	}
+	changeSetType := cloudformation.ChangeSetTypeUpdate
+	if stack == nil || *stack.StackStatus == cloudformation.StackStatusReviewInProgress {
+		log.WithField("stack-name", stackName).Debug("stack does not exist; planning stack creation")
+		changeSetType = cloudformation.ChangeSetTypeCreate
+	}
+
+	// Create the change set
+	createResp, err := svc.CreateChangeSet(cfg.CreateChangeSetInput(changeSetName, changeSetType, in))
 	if err != nil {
 		log.WithError(err).Error("cannot create change set to determine plan")
-		return err
+		return nil, nil, err
 	}
-	changeSetCreated = true
 	log.WithField("change-set-arn", *createResp.Id).Debug("created change set to determine plan")
 
+	discard := func() {
+		if stack == nil {
+			// Delete the stack created to hold the change set
+			delInput := &cloudformation.DeleteStackInput{
+				StackName: aws.String(stackName),
+			}
+			if _, err := svc.DeleteStack(delInput); err != nil {
+				log.WithField("stack-name", stackName).Error("cannot delete stack created for the change set")
+			} else {
+				log.WithField("stack-name", stackName).Debug("deleted stack created for the change set")
+			}
+			return
+		}
+
+		// Delete the change set
+		delInput := &cloudformation.DeleteChangeSetInput{
+			ChangeSetName: aws.String(changeSetName),
+			StackName:     aws.String(stackName),
+		}
+		if _, err := svc.DeleteChangeSet(delInput); err != nil {
+			log.WithField("change-set-name", changeSetName).Error("cannot delete change set")
+		} else {
+			log.WithField("change-set-name", changeSetName).Debug("deleted change set")
+		}
+	}
+
 	descInput := &cloudformation.DescribeChangeSetInput{
 		ChangeSetName: aws.String(changeSetName),
 		StackName:     aws.String(stackName),
 	}
-	descResp, err := describeAvailableChangeSet(svc, descInput)
+	ctx, stop := interruptContext()
+	descResp, err := describeAvailableChangeSet(ctx, svc, descInput)
+	stop()
+	if err == errNoChanges || err == errInterrupted {
+		return nil, discard, err
+	}
 	if err != nil {
 		log.WithError(err).Error("cannot retrieve change set status")
-		return err
+		return nil, discard, err
 	}
 
-	// TODO handle error returned
-	printChangeSetChanges(descResp)
+	// The hash of the deployed template is used to verify that the stack has
+	// not changed before a saved plan is executed
+	var templateHash string
+	if changeSetType == cloudformation.ChangeSetTypeUpdate {
+		if templateHash, err = cform.DeployedTemplateHash(svc, stackName); err != nil {
+			log.WithError(err).Error("cannot retrieve deployed template")
+			return nil, discard, err
+		}
+	}
 
-	return nil
+	// The deployed template is used to show the old values of the changed
+	// properties and to find the deletion policy of the removed resources
+	var deployed *cform.Template
+	if changeSetType == cloudformation.ChangeSetTypeUpdate && hasModifiedOrRemovedResources(descResp) {
+		if deployed, err = cform.DeployedTemplate(svc, stackName); err != nil {
+			log.WithError(err).Warn("cannot retrieve deployed template; old property values are not shown and removed resources are assumed to be deleted")
+		}
+	}
+
+	p := &cform.Plan{
+		Version:               cform.PlanVersion,
+		StackName:             stackName,
+		StackID:               cform.DerefString(createResp.StackId, ""),
+		ChangeSetID:           *createResp.Id,
+		ChangeSetName:         changeSetName,
+		ChangeSetType:         changeSetType,
+		TemplateHash:          templateHash,
+		Parameters:            cform.PlanParameters(in.Parameters, tmpl.Parameters()),
+		Capabilities:          in.Capabilities,
+		TerminationProtection: cfg.TerminationProtection,
+		StackPolicyBody:       policy,
+		Changes:               cform.PlanChanges(descResp, tmpl, deployed),
+	}
+	if stack != nil {
+		p.StackLastUpdatedTime = stack.LastUpdatedTime
+	}
+	cform.ClassifyRisks(p.Changes, tmpl, deployed, cfg.ProtectedResources)
+
+	if err := describeNestedChanges(svc, p.Changes, cfg.ProtectedResources); err != nil {
+		return nil, discard, err
+	}
+	return p, discard, nil
 }
 
-// printChangeSetChanges prints the changes to any new or existing resources
-// to standard out.
-func printChangeSetChanges(status *cloudformation.DescribeChangeSetOutput) error {
-	for _, change := range status.Changes {
-		rs := change.ResourceChange
-		action := *rs.Action
-
-		var c color.Attribute
-		if action == "Add" {
-			c = color.FgGreen
-		} else if action == "Modify" {
-			c = color.FgYellow
-		} else if action == "Remove" {
-			c = color.FgRed
-		} else {
-			return fmt.Errorf("Unknown action: %s", action)
+// describeNestedChanges sets the changes to the resources of the nested stacks
+// which are changed by the changes, and of their nested stacks in turn, using
+// the change sets which CloudFormation creates for the nested stacks along
+// with the change set of their parent. The nested change sets are deleted
+// along with the change set of the parent.
+//
+// The protected resources of a nested stack are qualified by the logical ID
+// of the nested stack, e.g. `Network/Vpc`.
+func describeNestedChanges(svc cloudformationiface.CloudFormationAPI, changes []cform.PlanChange, protected []string) error {
+	for i := range changes {
+		c := &changes[i]
+		if c.ChangeSetID == "" {
+			continue
+		}
+
+		input := &cloudformation.DescribeChangeSetInput{ChangeSetName: aws.String(c.ChangeSetID)}
+		resp, err := svc.DescribeChangeSet(input)
+		if err == nil {
+			resp, err = describeRemainingChanges(svc, input, resp)
+		}
+		if err != nil {
+			log.WithError(err).WithField("nested-stack", c.LogicalResourceID).Error("cannot retrieve nested change set")
+			return err
 		}
-		cPrint := color.New(c)
-		cPrint.Printf("%s (%s)\n", *rs.LogicalResourceId, *rs.ResourceType)
 
-		fmt.Printf("\t%-15s: %s\n", "action", *rs.Action)
-		fmt.Printf("\t%-15s: %s\n", "physical-id", cform.DerefString(rs.PhysicalResourceId, "<NA>"))
-		fmt.Printf("\t%-15s: %s\n\n", "replacement", cform.DerefString(rs.Replacement, "<NA>"))
+		tmpl, err := cform.ChangeSetTemplate(svc, c.ChangeSetID)
+		if err != nil {
+			log.WithError(err).WithField("nested-stack", c.LogicalResourceID).Warn("cannot retrieve template of nested change set; new property values are not shown")
+		}
+		var deployed *cform.Template
+		if c.Action == cloudformation.ChangeActionModify && hasModifiedOrRemovedResources(resp) {
+			if deployed, err = cform.DeployedTemplate(svc, c.PhysicalResourceID); err != nil {
+				log.WithError(err).WithField("nested-stack", c.LogicalResourceID).Warn("cannot retrieve deployed template of nested stack; old property values are not shown and removed resources are assumed to be deleted")
+			}
+		}
+
+		c.NestedChanges = cform.PlanChanges(resp, tmpl, deployed)
+		for j := range c.NestedChanges {
+			// The nested templates are not part of the template sources
+			c.NestedChanges[j].Source = ""
+		}
+
+		nestedProtected := cform.NestedProtectedResources(protected, c.LogicalResourceID)
+		cform.ClassifyRisks(c.NestedChanges, tmpl, deployed, nestedProtected)
+		if err := describeNestedChanges(svc, c.NestedChanges, nestedProtected); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// hasModifiedOrRemovedResources checks if the change set modifies or removes
+// any resource.
+func hasModifiedOrRemovedResources(cs *cloudformation.DescribeChangeSetOutput) bool {
+	for _, c := range cs.Changes {
+		if c.ResourceChange == nil {
+			continue
+		}
+		switch cform.DerefString(c.ResourceChange.Action, "") {
+		case cloudformation.ChangeActionModify, cloudformation.ChangeActionRemove:
+			return true
+		}
+	}
+	return false
+}
+
+// errInterrupted is returned if the wait for a change set is interrupted.
+var errInterrupted = errors.New("interrupted while waiting for the change set")
+
+// changeSetWait configures how long and how often the status of a change set
+// is polled while it is being created. The delay between the polls starts at
+// minDelay and doubles up to maxDelay, so that small change sets are available
+// quickly and large ones are not polled needlessly often.
+var changeSetWait = struct {
+	timeout  time.Duration
+	minDelay time.Duration
+	maxDelay time.Duration
+
+	// Waits longer than this are logged as progress instead of debug
+	// information
+	progressAfter time.Duration
+}{
+	timeout:       5 * time.Minute,
+	minDelay:      time.Second,
+	maxDelay:      15 * time.Second,
+	progressAfter: 15 * time.Second,
+}
+
+// interruptContext returns a context which is cancelled when the process is
+// interrupted, e.g. using Ctrl-C, and a function which stops listening for
+// the interrupt.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigs)
+		cancel()
+	}
+}
+
 // describeAvailableChangeSet waits for the change set to be created and then
-// returns the status of the change set.
-func describeAvailableChangeSet(svc cloudformationiface.CloudFormationAPI, input *cloudformation.DescribeChangeSetInput) (*cloudformation.DescribeChangeSetOutput, error) {
-	timeout := time.After(60 * time.Second)
-	tick := time.Tick(2000 * time.Millisecond)
+// returns the status of the change set. The status is polled with an
+// exponential backoff and jitter until the change set is created, it fails,
+// the wait times out or the context is cancelled, in which case
+// errInterrupted is returned. errNoChanges is returned if the change set
+// failed because it does not change the stack.
+func describeAvailableChangeSet(ctx context.Context, svc cloudformationiface.CloudFormationAPI, input *cloudformation.DescribeChangeSetInput) (*cloudformation.DescribeChangeSetOutput, error) {
+	start := time.Now()
+	deadline := start.Add(changeSetWait.timeout)
+	delay := changeSetWait.minDelay
 
 	for {
+		// Sleep for a random duration between half and all of the delay so
+		// that concurrent plans do not poll in lockstep
+		sleep := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if remaining := time.Until(deadline); sleep > remaining {
+			sleep = remaining
+		}
+
+		timer := time.NewTimer(sleep)
 		select {
-		case <-timeout:
-			err := errors.New("change set creation timed out")
-			log.Error(err)
+		case <-ctx.Done():
+			timer.Stop()
+			log.Warn("interrupted while waiting for the change set")
+			return nil, errInterrupted
+		case <-timer.C:
+		}
+
+		resp, err := svc.DescribeChangeSet(input)
+		if err != nil {
+			log.WithError(err).Error("cannot retrieve change set status")
 			return nil, err
-		case <-tick:
-			resp, err := svc.DescribeChangeSet(input)
-			if err != nil {
-				log.WithError(err).Error("cannot retrieve change set status")
-				return nil, err
-			}
+		}
 
-			status := *resp.Status
+		status := *resp.Status
 
-			if status == cloudformation.ChangeSetStatusFailed {
-				return nil, fmt.Errorf("cannot create change set: %s", *resp.StatusReason)
+		if status == cloudformation.ChangeSetStatusFailed {
+			if isNoChangesReason(cform.DerefString(resp.StatusReason, "")) {
+				return nil, errNoChanges
 			}
+			return nil, fmt.Errorf("cannot create change set: %s", *resp.StatusReason)
+		}
 
-			if status == cloudformation.ChangeSetStatusCreateComplete {
-				return resp, nil
-			}
+		if status == cloudformation.ChangeSetStatusCreateComplete {
+			return describeRemainingChanges(svc, input, resp)
+		}
+
+		elapsed := time.Since(start)
+		if !time.Now().Before(deadline) {
+			err := errors.New("change set creation timed out")
+			log.WithField("timeout", changeSetWait.timeout).Error(err)
+			return nil, err
+		}
+
+		entry := log.WithFields(log.Fields{"change-set-status": status, "elapsed": elapsed.Round(time.Second)})
+		if elapsed >= changeSetWait.progressAfter {
+			entry.Info("waiting for change set to be available...")
+		} else {
+			entry.Debug("waiting for change set to be available...")
+		}
 
-			log.WithField("change-set-status", status).Debug("waiting for change set to be available...")
+		if delay *= 2; delay > changeSetWait.maxDelay {
+			delay = changeSetWait.maxDelay
 		}
 	}
 }
 
+// describeRemainingChanges retrieves the remaining pages of the changes of a
+// change set whose first page is the response and returns a copy of the
+// response with the changes of all the pages. A change set lists a limited
+// number of changes per page, hence the changes of large stacks are spread
+// across multiple pages.
+func describeRemainingChanges(svc cloudformationiface.CloudFormationAPI, input *cloudformation.DescribeChangeSetInput,
+	first *cloudformation.DescribeChangeSetOutput) (*cloudformation.DescribeChangeSetOutput, error) {
+	resp := *first
+	resp.Changes = append([]*cloudformation.Change(nil), first.Changes...)
+
+	for resp.NextToken != nil && *resp.NextToken != "" {
+		pageInput := *input
+		pageInput.NextToken = resp.NextToken
+
+		page, err := svc.DescribeChangeSet(&pageInput)
+		if err != nil {
+			log.WithError(err).Error("cannot retrieve change set changes")
+			return nil, err
+		}
+		log.WithField("changes", len(page.Changes)).Debug("retrieved next page of change set changes")
+
+		resp.Changes = append(resp.Changes, page.Changes...)
+		resp.NextToken = page.NextToken
+	}
+	return &resp, nil
+}
+
+// isNoChangesReason checks if the reason why a change set failed is that it
+// does not change the stack.
+func isNoChangesReason(reason string) bool {
+	return strings.Contains(reason, "didn't contain changes") || strings.Contains(reason, "No updates are to be performed")
+}
+
 func init() {
 	planCmd.Flags().StringVar(&planCmdFlags.stackName, "stack-name", "", "Name of the CloudFormation stack")
 	planCmd.Flags().StringVar(&planCmdFlags.stackConfigFile, "stack-config", "", "Path to stack config file")
+	planCmd.Flags().StringVar(&planCmdFlags.env, "env", "", "Name of the environment whose stack config is used")
+	planCmd.Flags().StringVar(&planCmdFlags.envDir, "env-dir", "environments", "Directory containing the stack configs of the environments")
+	planCmd.Flags().StringArrayVar(&planCmdFlags.parameters, "parameter", nil, "Parameter value as Key=Value which overrides the stack config; can be repeated")
 	planCmd.Flags().StringVar(&planCmdFlags.changeSetName, "change-set-name", "", "Name of the change set")
 	planCmd.Flags().BoolVar(&planCmdFlags.keepChangeSet, "keep-change-set", false, "Retain the change set created to prepare the plan")
+	planCmd.Flags().StringVar(&planCmdFlags.out, "out", "", "Save the plan to the file so that it can be executed by apply")
+	planCmd.Flags().StringVar(&planCmdFlags.format, "format", textFormat, "Format of the plan (text, json or markdown)")
+	planCmd.Flags().DurationVar(&planCmdFlags.changeSetTimeout, "change-set-timeout", changeSetWait.timeout, "Maximum time to wait for the change set to be created")
+	planCmd.Flags().BoolVar(&planCmdFlags.detailedExitCode, "detailed-exitcode", false, "Exit with 0 if there are no changes, 1 on errors and 2 if there are changes")
 
 	rootCmd.AddCommand(planCmd)
 }
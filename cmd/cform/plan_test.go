@@ -1,18 +1,28 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	cf "github.com/aws/aws-sdk-go/service/cloudformation"
 	cfi "github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/isubuz/cform"
 )
 
 type createCSFn func(*cf.CreateChangeSetInput) (*cf.CreateChangeSetOutput, error)
 type deleteCSFn func(*cf.DeleteChangeSetInput) (*cf.DeleteChangeSetOutput, error)
 type descCSFn func(*cf.DescribeChangeSetInput) (*cf.DescribeChangeSetOutput, error)
+type descStacksFn func(*cf.DescribeStacksInput) (*cf.DescribeStacksOutput, error)
 
 type mockCSClient struct {
 	cfi.CloudFormationAPI
@@ -22,6 +32,10 @@ type mockCSClient struct {
 	descCS   descCSFn
 	csId     string
 	csName   string
+
+	// Stacks are assumed to exist unless descStacks is set
+	descStacks   descStacksFn
+	stackDeleted bool
 }
 
 func (m *mockCSClient) CreateChangeSet(input *cf.CreateChangeSetInput) (*cf.CreateChangeSetOutput, error) {
@@ -39,6 +53,25 @@ func (m *mockCSClient) DescribeChangeSet(input *cf.DescribeChangeSetInput) (*cf.
 	return m.descCS(input)
 }
 
+func (m *mockCSClient) DescribeStacks(input *cf.DescribeStacksInput) (*cf.DescribeStacksOutput, error) {
+	if m.descStacks == nil {
+		stack := &cf.Stack{StackName: input.StackName, StackStatus: aws.String(cf.StackStatusCreateComplete)}
+		return &cf.DescribeStacksOutput{Stacks: []*cf.Stack{stack}}, nil
+	}
+	return m.descStacks(input)
+}
+
+func (m *mockCSClient) GetTemplate(input *cf.GetTemplateInput) (*cf.GetTemplateOutput, error) {
+	return &cf.GetTemplateOutput{TemplateBody: aws.String("Resources: {}\n")}, nil
+}
+
+func (m *mockCSClient) DeleteStack(input *cf.DeleteStackInput) (*cf.DeleteStackOutput, error) {
+	// deleting the stack also deletes its change sets
+	m.stackDeleted = true
+	m.csId = ""
+	return &cf.DeleteStackOutput{}, nil
+}
+
 func (m *mockCSClient) DeleteChangeSet(input *cf.DeleteChangeSetInput) (*cf.DeleteChangeSetOutput, error) {
 	r, err := m.deleteCS(input)
 	if err == nil && (m.csName == *input.ChangeSetName) {
@@ -48,6 +81,14 @@ func (m *mockCSClient) DeleteChangeSet(input *cf.DeleteChangeSetInput) (*cf.Dele
 	return r, err
 }
 
+func TestMain(m *testing.M) {
+	// Poll the change sets of the mocks without waiting
+	changeSetWait.timeout = time.Second
+	changeSetWait.minDelay = time.Millisecond
+	changeSetWait.maxDelay = 10 * time.Millisecond
+	os.Exit(m.Run())
+}
+
 // Test failure of the AWS API call to describe the change set
 func TestDescCSRetrieveStatusFailed(t *testing.T) {
 	expErr := errors.New("change-set describe api failed")
@@ -55,9 +96,9 @@ func TestDescCSRetrieveStatusFailed(t *testing.T) {
 		return nil, expErr
 	}
 	mock := &mockCSClient{descCS: f}
-	r, err := describeAvailableChangeSet(mock, &cf.DescribeChangeSetInput{})
+	r, err := describeAvailableChangeSet(context.Background(), mock, &cf.DescribeChangeSetInput{})
 	if r != nil {
-		t.Errorf("Unexpected non nil return value, ", r)
+		t.Errorf("Unexpected non nil return value: %v", r)
 	}
 	if err.Error() != expErr.Error() {
 		t.Errorf("Expected (%s), Found (%s)", expErr, err)
@@ -76,7 +117,7 @@ func TestDescCSCreateCompleteTimeout(t *testing.T) {
 		return o, nil
 	}
 	mock := &mockCSClient{descCS: f}
-	_, err := describeAvailableChangeSet(mock, &cf.DescribeChangeSetInput{})
+	_, err := describeAvailableChangeSet(context.Background(), mock, &cf.DescribeChangeSetInput{})
 	if err.Error() != expErr.Error() {
 		t.Errorf("Expected (%s), Found (%s)", expErr, err)
 	}
@@ -93,7 +134,7 @@ func TestDescCSCreateFailed(t *testing.T) {
 		return o, nil
 	}
 	mock := &mockCSClient{descCS: f}
-	_, err := describeAvailableChangeSet(mock, &cf.DescribeChangeSetInput{})
+	_, err := describeAvailableChangeSet(context.Background(), mock, &cf.DescribeChangeSetInput{})
 	if err.Error() != expErr.Error() {
 		t.Errorf("Expected (%s), Found (%s)", expErr, err)
 	}
@@ -110,12 +151,103 @@ func TestDescCSCreateComplete(t *testing.T) {
 		return o, nil
 	}
 	mock := &mockCSClient{descCS: f}
-	_, err := describeAvailableChangeSet(mock, &cf.DescribeChangeSetInput{})
+	_, err := describeAvailableChangeSet(context.Background(), mock, &cf.DescribeChangeSetInput{})
 	if err != nil {
 		t.Errorf("Unexpected error (%s)", err)
 	}
 }
 
+// Test that a change set which failed because it does not contain changes is
+// reported as no changes
+func TestDescCSNoChanges(t *testing.T) {
+	o := &cf.DescribeChangeSetOutput{
+		Status:       aws.String(cf.ChangeSetStatusFailed),
+		StatusReason: aws.String("The submitted information didn't contain changes. Submit different information to create a change set."),
+	}
+	f := func(i *cf.DescribeChangeSetInput) (*cf.DescribeChangeSetOutput, error) {
+		return o, nil
+	}
+	mock := &mockCSClient{descCS: f}
+	if _, err := describeAvailableChangeSet(context.Background(), mock, &cf.DescribeChangeSetInput{}); err != errNoChanges {
+		t.Errorf("Expected (%s), Found (%v)", errNoChanges, err)
+	}
+}
+
+// Test that the wait for the change set stops once it is interrupted
+func TestDescCSInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	polls := 0
+	f := func(i *cf.DescribeChangeSetInput) (*cf.DescribeChangeSetOutput, error) {
+		if polls++; polls == 3 {
+			cancel()
+		}
+		return &cf.DescribeChangeSetOutput{Status: aws.String(cf.ChangeSetStatusCreateInProgress)}, nil
+	}
+	mock := &mockCSClient{descCS: f}
+	if _, err := describeAvailableChangeSet(ctx, mock, &cf.DescribeChangeSetInput{}); err != errInterrupted {
+		t.Errorf("Expected (%s), Found (%v)", errInterrupted, err)
+	}
+	if polls != 3 {
+		t.Errorf("Expected (3) polls, Found (%d)", polls)
+	}
+}
+
+// Test retrieval of the changes of a change set which are spread across
+// multiple pages
+func TestDescCSMultiplePages(t *testing.T) {
+	pages := map[string]*cf.DescribeChangeSetOutput{
+		"":   {NextToken: aws.String("p2")},
+		"p2": {NextToken: aws.String("p3")},
+		"p3": {},
+	}
+	for token, page := range pages {
+		page.Status = aws.String(cf.ChangeSetStatusCreateComplete)
+		for i := 0; i < 2; i++ {
+			page.Changes = append(page.Changes, &cf.Change{ResourceChange: &cf.ResourceChange{
+				Action:            aws.String(cf.ChangeActionAdd),
+				LogicalResourceId: aws.String(fmt.Sprintf("Bucket%s%d", token, i)),
+				ResourceType:      aws.String("AWS::S3::Bucket"),
+			}})
+		}
+	}
+
+	input := &cf.DescribeChangeSetInput{ChangeSetName: aws.String("testcs"), StackName: aws.String("test-stack")}
+	f := func(i *cf.DescribeChangeSetInput) (*cf.DescribeChangeSetOutput, error) {
+		if *i.ChangeSetName != "testcs" || *i.StackName != "test-stack" {
+			t.Errorf("Unexpected change set %s of stack %s", *i.ChangeSetName, *i.StackName)
+		}
+		return pages[cform.DerefString(i.NextToken, "")], nil
+	}
+	mock := &mockCSClient{descCS: f}
+	resp, err := describeAvailableChangeSet(context.Background(), mock, input)
+	if err != nil {
+		t.Fatalf("Unexpected error (%s)", err)
+	}
+
+	var found []string
+	for _, c := range resp.Changes {
+		found = append(found, *c.ResourceChange.LogicalResourceId)
+	}
+	expected := "Bucket0 Bucket1 Bucketp20 Bucketp21 Bucketp30 Bucketp31"
+	if strings.Join(found, " ") != expected {
+		t.Errorf("Expected (%s), Found (%s)", expected, strings.Join(found, " "))
+	}
+	if input.NextToken != nil {
+		t.Errorf("Unexpected change to the input (%s)", *input.NextToken)
+	}
+
+	failed := errors.New("change-set describe api failed")
+	mock.descCS = func(i *cf.DescribeChangeSetInput) (*cf.DescribeChangeSetOutput, error) {
+		if i.NextToken != nil {
+			return nil, failed
+		}
+		return f(i)
+	}
+	if _, err := describeAvailableChangeSet(context.Background(), mock, input); err != failed {
+		t.Errorf("Expected (%s), Found (%v)", failed, err)
+	}
+}
+
 // Test plan command failure when the AWS API call to create the
 // change set fails
 func TestPlanCSCreateAPIFailed(t *testing.T) {
@@ -126,7 +258,7 @@ func TestPlanCSCreateAPIFailed(t *testing.T) {
 
 	mock := &mockCSClient{createCS: createFn}
 
-	err := plan(mock, "", "", "", "test", true)
+	_, err := plan(mock, cform.NewTemplate(cform.MergeOptions{}), &cform.StackConfig{}, "test", true, "")
 	if err.Error() != expErr.Error() {
 		t.Errorf("Expected (%s), Found (%s)", expErr.Error(), err.Error())
 	}
@@ -150,7 +282,7 @@ func TestPlanCSDescFailedKeepCS(t *testing.T) {
 
 	mock := &mockCSClient{createCS: createFn, descCS: descFn, csName: csName}
 
-	err := plan(mock, "", "", "", csName, true)
+	_, err := plan(mock, cform.NewTemplate(cform.MergeOptions{}), &cform.StackConfig{}, csName, true, "")
 	if err.Error() != expErr.Error() {
 		t.Errorf("Expected (%s), Found (%s)", expErr.Error(), err.Error())
 	}
@@ -159,6 +291,85 @@ func TestPlanCSDescFailedKeepCS(t *testing.T) {
 	}
 }
 
+// Test retention of the change set when the wait for the change set times
+// out
+func TestPlanCSTimeoutKeepCS(t *testing.T) {
+	createFn := func(i *cf.CreateChangeSetInput) (*cf.CreateChangeSetOutput, error) {
+		return &cf.CreateChangeSetOutput{Id: aws.String("testcs-id")}, nil
+	}
+	descFn := func(i *cf.DescribeChangeSetInput) (*cf.DescribeChangeSetOutput, error) {
+		return &cf.DescribeChangeSetOutput{Status: aws.String(cf.ChangeSetStatusCreateInProgress)}, nil
+	}
+	defer func(timeout time.Duration) { changeSetWait.timeout = timeout }(changeSetWait.timeout)
+	changeSetWait.timeout = 20 * time.Millisecond
+
+	mock := &mockCSClient{createCS: createFn, descCS: descFn, csName: "testcs"}
+
+	_, err := plan(mock, cform.NewTemplate(cform.MergeOptions{}), &cform.StackConfig{}, "testcs", true, "")
+	if err == nil || err.Error() != "change set creation timed out" {
+		t.Errorf("Expected (change set creation timed out), Found (%v)", err)
+	}
+	if mock.csId == "" {
+		t.Errorf("Unexpected deletion of change set")
+	}
+}
+
+// Test retention of the stack created to hold a failed change set when the
+// plan is saved
+func TestPlanCSFailedOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cform")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "plan.cform")
+
+	createFn := func(i *cf.CreateChangeSetInput) (*cf.CreateChangeSetOutput, error) {
+		return &cf.CreateChangeSetOutput{Id: aws.String("testcs-id")}, nil
+	}
+	descFn := func(i *cf.DescribeChangeSetInput) (*cf.DescribeChangeSetOutput, error) {
+		return &cf.DescribeChangeSetOutput{
+			Status:       aws.String(cf.ChangeSetStatusFailed),
+			StatusReason: aws.String("Template format error: Unresolved resource dependencies [Vpc]"),
+		}, nil
+	}
+	descStacksFn := func(i *cf.DescribeStacksInput) (*cf.DescribeStacksOutput, error) {
+		return nil, awserr.New("ValidationError", "Stack with id test-stack does not exist", nil)
+	}
+
+	mock := &mockCSClient{createCS: createFn, descCS: descFn, descStacks: descStacksFn, csName: "testcs"}
+
+	cfg := &cform.StackConfig{StackName: "test-stack"}
+	if _, err := plan(mock, cform.NewTemplate(cform.MergeOptions{}), cfg, "testcs", false, out); err == nil {
+		t.Errorf("Expected error for failed change set")
+	}
+	if mock.stackDeleted {
+		t.Errorf("Unexpected deletion of stack created for the change set")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("Unexpected plan saved for failed change set")
+	}
+}
+
+// Test retention of the change set when the plan cannot be saved
+func TestPlanOutWriteFailed(t *testing.T) {
+	createFn := func(i *cf.CreateChangeSetInput) (*cf.CreateChangeSetOutput, error) {
+		return &cf.CreateChangeSetOutput{Id: aws.String("testcs-id")}, nil
+	}
+	descFn := func(i *cf.DescribeChangeSetInput) (*cf.DescribeChangeSetOutput, error) {
+		return &cf.DescribeChangeSetOutput{Status: aws.String(cf.ChangeSetStatusCreateComplete)}, nil
+	}
+	mock := &mockCSClient{createCS: createFn, descCS: descFn, csName: "testcs"}
+
+	out := filepath.Join(os.TempDir(), "cform-missing-dir", "plan.cform")
+	if _, err := plan(mock, cform.NewTemplate(cform.MergeOptions{}), &cform.StackConfig{}, "testcs", false, out); err == nil {
+		t.Errorf("Expected error for plan which cannot be saved")
+	}
+	if mock.csId == "" {
+		t.Errorf("Unexpected deletion of change set")
+	}
+}
+
 // Test deletion of the change set when the change set cannot be created
 // to determine the execution plan
 func TestPlanCSDescFailedDeleteCS(t *testing.T) {
@@ -180,7 +391,7 @@ func TestPlanCSDescFailedDeleteCS(t *testing.T) {
 
 	mock := &mockCSClient{createCS: createFn, deleteCS: deleteFn, descCS: descFn, csName: csName}
 
-	err := plan(mock, "", "", "", csName, false)
+	_, err := plan(mock, cform.NewTemplate(cform.MergeOptions{}), &cform.StackConfig{}, csName, false, "")
 	if err.Error() != expErr.Error() {
 		t.Errorf("Expected (%s), Found (%s)", expErr.Error(), err.Error())
 	}
@@ -209,7 +420,7 @@ func TestPlanKeepCS(t *testing.T) {
 
 	mock := &mockCSClient{createCS: createFn, descCS: descFn, csName: csName}
 
-	err := plan(mock, "", "", "", csName, true)
+	_, err := plan(mock, cform.NewTemplate(cform.MergeOptions{}), &cform.StackConfig{}, csName, true, "")
 	if err != nil {
 		t.Errorf("Unexpected error (%s)", err)
 	}
@@ -241,11 +452,296 @@ func TestPlanDeleteCS(t *testing.T) {
 
 	mock := &mockCSClient{createCS: createFn, deleteCS: deleteFn, descCS: descFn, csName: csName}
 
-	err := plan(mock, "", "", "", csName, false)
+	_, err := plan(mock, cform.NewTemplate(cform.MergeOptions{}), &cform.StackConfig{}, csName, false, "")
+	if err != nil {
+		t.Errorf("Unexpected error (%s)", err)
+	}
+	if mock.csId != "" {
+		t.Errorf("Change set not deleted")
+	}
+}
+
+// Test creation of the change set using the stack config
+func TestPlanStackConfig(t *testing.T) {
+	cfg := &cform.StackConfig{
+		StackName:    "test-stack",
+		Parameters:   map[string]cform.ParameterValue{"Env": {Value: "prod"}},
+		Capabilities: []string{cf.CapabilityCapabilityIam},
+		RoleARN:      "arn:aws:iam::123456789012:role/cfn",
+	}
+
+	var createIn *cf.CreateChangeSetInput
+	createFn := func(i *cf.CreateChangeSetInput) (*cf.CreateChangeSetOutput, error) {
+		createIn = i
+		return &cf.CreateChangeSetOutput{Id: aws.String("testcs-id")}, nil
+	}
+	descFn := func(i *cf.DescribeChangeSetInput) (*cf.DescribeChangeSetOutput, error) {
+		return &cf.DescribeChangeSetOutput{Status: aws.String(cf.ChangeSetStatusCreateComplete)}, nil
+	}
+
+	mock := &mockCSClient{createCS: createFn, descCS: descFn, csName: "testcs"}
+
+	tmpl := cform.NewTemplate(cform.MergeOptions{})
+	if err := tmpl.Add("params.yml", []byte("Parameters:\n  Env:\n    Type: String\n")); err != nil {
+		t.Errorf("Failed to create template: %s", err)
+		return
+	}
+
+	if _, err := plan(mock, tmpl, cfg, "testcs", true, ""); err != nil {
+		t.Errorf("Unexpected error (%s)", err)
+		return
+	}
+
+	if *createIn.StackName != cfg.StackName || *createIn.RoleARN != cfg.RoleARN {
+		t.Errorf("Expected stack (%s) and role (%s), Found (%s) and (%s)", cfg.StackName, cfg.RoleARN,
+			*createIn.StackName, *createIn.RoleARN)
+	}
+	if len(createIn.Parameters) != 1 || *createIn.Parameters[0].ParameterValue != "prod" {
+		t.Errorf("Expected parameter Env=prod, Found (%v)", createIn.Parameters)
+	}
+	if len(createIn.Capabilities) != 1 || *createIn.Capabilities[0] != cf.CapabilityCapabilityIam {
+		t.Errorf("Expected capability (%s), Found (%v)", cf.CapabilityCapabilityIam, createIn.Capabilities)
+	}
+}
+
+// Test creation of a CREATE change set for a stack which does not exist and
+// deletion of the stack created to hold the change set
+func TestPlanNewStack(t *testing.T) {
+	for _, keepChangeSet := range []bool{false, true} {
+		var createIn *cf.CreateChangeSetInput
+		createFn := func(i *cf.CreateChangeSetInput) (*cf.CreateChangeSetOutput, error) {
+			createIn = i
+			return &cf.CreateChangeSetOutput{Id: aws.String("testcs-id")}, nil
+		}
+		descFn := func(i *cf.DescribeChangeSetInput) (*cf.DescribeChangeSetOutput, error) {
+			return &cf.DescribeChangeSetOutput{Status: aws.String(cf.ChangeSetStatusCreateComplete)}, nil
+		}
+		descStacksFn := func(i *cf.DescribeStacksInput) (*cf.DescribeStacksOutput, error) {
+			return nil, awserr.New("ValidationError", "Stack with id test-stack does not exist", nil)
+		}
+		deleteFn := func(i *cf.DeleteChangeSetInput) (*cf.DeleteChangeSetOutput, error) {
+			t.Errorf("Unexpected deletion of change set instead of stack")
+			return nil, nil
+		}
+
+		mock := &mockCSClient{createCS: createFn, deleteCS: deleteFn, descCS: descFn, descStacks: descStacksFn, csName: "testcs"}
+
+		cfg := &cform.StackConfig{StackName: "test-stack"}
+		if _, err := plan(mock, cform.NewTemplate(cform.MergeOptions{}), cfg, "testcs", keepChangeSet, ""); err != nil {
+			t.Errorf("Unexpected error (%s)", err)
+			continue
+		}
+
+		if *createIn.ChangeSetType != cf.ChangeSetTypeCreate {
+			t.Errorf("Expected (%s), Found (%s)", cf.ChangeSetTypeCreate, *createIn.ChangeSetType)
+		}
+		if mock.stackDeleted == keepChangeSet {
+			t.Errorf("Expected stack deleted (%v), Found (%v)", !keepChangeSet, mock.stackDeleted)
+		}
+	}
+}
+
+// Test failure of the AWS API call to check if the stack exists
+func TestPlanDescStacksFailed(t *testing.T) {
+	expErr := errors.New("describe stacks api failed")
+	descStacksFn := func(i *cf.DescribeStacksInput) (*cf.DescribeStacksOutput, error) {
+		return nil, expErr
+	}
+	mock := &mockCSClient{descStacks: descStacksFn}
+
+	_, err := plan(mock, cform.NewTemplate(cform.MergeOptions{}), &cform.StackConfig{}, "testcs", false, "")
+	if err != expErr {
+		t.Errorf("Expected (%s), Found (%v)", expErr, err)
+	}
+}
+
+// Test the plan returned after a successful plan cmd execution
+func TestPlanResult(t *testing.T) {
+	lastUpdated := time.Date(2017, 1, 7, 23, 31, 1, 0, time.UTC)
+	descStacksFn := func(i *cf.DescribeStacksInput) (*cf.DescribeStacksOutput, error) {
+		stack := &cf.Stack{StackStatus: aws.String(cf.StackStatusUpdateComplete), LastUpdatedTime: &lastUpdated}
+		return &cf.DescribeStacksOutput{Stacks: []*cf.Stack{stack}}, nil
+	}
+	createFn := func(i *cf.CreateChangeSetInput) (*cf.CreateChangeSetOutput, error) {
+		return &cf.CreateChangeSetOutput{Id: aws.String("testcs-id"), StackId: aws.String("test-stack-id")}, nil
+	}
+	descFn := func(i *cf.DescribeChangeSetInput) (*cf.DescribeChangeSetOutput, error) {
+		change := &cf.Change{ResourceChange: &cf.ResourceChange{
+			Action:            aws.String(cf.ChangeActionAdd),
+			LogicalResourceId: aws.String("Bucket"),
+			ResourceType:      aws.String("AWS::S3::Bucket"),
+		}}
+		return &cf.DescribeChangeSetOutput{Status: aws.String(cf.ChangeSetStatusCreateComplete), Changes: []*cf.Change{change}}, nil
+	}
+	deleteFn := func(i *cf.DeleteChangeSetInput) (*cf.DeleteChangeSetOutput, error) {
+		return nil, nil
+	}
+
+	mock := &mockCSClient{createCS: createFn, deleteCS: deleteFn, descCS: descFn, descStacks: descStacksFn, csName: "testcs"}
+
+	tmpl := cform.NewTemplate(cform.MergeOptions{})
+	d := "Parameters:\n  Password:\n    Type: String\n    NoEcho: true\nResources:\n  Bucket:\n    Type: AWS::S3::Bucket\n"
+	if err := tmpl.Add("storage.yml", []byte(d)); err != nil {
+		t.Errorf("Failed to create template: %s", err)
+		return
+	}
+	cfg := &cform.StackConfig{
+		StackName:  "test-stack",
+		Parameters: map[string]cform.ParameterValue{"Password": {Value: "s3cr3t"}},
+	}
+
+	p, err := plan(mock, tmpl, cfg, "testcs", false, "")
 	if err != nil {
 		t.Errorf("Unexpected error (%s)", err)
+		return
+	}
+
+	if p.StackLastUpdatedTime == nil || !p.StackLastUpdatedTime.Equal(lastUpdated) {
+		t.Errorf("Expected (%s), Found (%v)", lastUpdated, p.StackLastUpdatedTime)
+	}
+
+	expected := &cform.Plan{
+		Version:              cform.PlanVersion,
+		StackName:            "test-stack",
+		StackID:              "test-stack-id",
+		StackLastUpdatedTime: p.StackLastUpdatedTime,
+		ChangeSetID:          "testcs-id",
+		ChangeSetName:        "testcs",
+		ChangeSetType:        cf.ChangeSetTypeUpdate,
+		TemplateHash:         cform.Checksum([]byte("Resources: {}\n")),
+		Parameters:           []cform.PlanParameter{{Name: "Password", Value: "****"}},
+		Capabilities:         p.Capabilities,
+		Changes: []cform.PlanChange{
+			{Action: cf.ChangeActionAdd, LogicalResourceID: "Bucket", ResourceType: "AWS::S3::Bucket", Scope: []string{}, Source: "storage.yml:6"},
+		},
+	}
+	if len(p.Capabilities) != 0 {
+		t.Errorf("Unexpected capabilities (%v)", p.Capabilities)
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("Expected (%+v), Found (%+v)", expected, p)
+	}
+}
+
+// Test deletion of the change set which does not contain changes even if the
+// change set is retained
+func TestPlanNoChanges(t *testing.T) {
+	createFn := func(i *cf.CreateChangeSetInput) (*cf.CreateChangeSetOutput, error) {
+		return &cf.CreateChangeSetOutput{Id: aws.String("testcs-id")}, nil
+	}
+	descFn := func(i *cf.DescribeChangeSetInput) (*cf.DescribeChangeSetOutput, error) {
+		return &cf.DescribeChangeSetOutput{
+			Status:       aws.String(cf.ChangeSetStatusFailed),
+			StatusReason: aws.String("No updates are to be performed."),
+		}, nil
+	}
+	deleteFn := func(i *cf.DeleteChangeSetInput) (*cf.DeleteChangeSetOutput, error) {
+		return nil, nil
+	}
+
+	mock := &mockCSClient{createCS: createFn, deleteCS: deleteFn, descCS: descFn, csName: "testcs"}
+
+	_, err := plan(mock, cform.NewTemplate(cform.MergeOptions{}), &cform.StackConfig{}, "testcs", true, "")
+	if err != errNoChanges {
+		t.Errorf("Expected (%s), Found (%v)", errNoChanges, err)
 	}
 	if mock.csId != "" {
 		t.Errorf("Change set not deleted")
 	}
 }
+
+// mockNestedClient describes the change sets and returns the templates keyed
+// by the change set ARN or the stack name.
+type mockNestedClient struct {
+	cfi.CloudFormationAPI
+
+	changeSets map[string]*cf.DescribeChangeSetOutput
+	templates  map[string]string
+}
+
+func (m *mockNestedClient) DescribeChangeSet(input *cf.DescribeChangeSetInput) (*cf.DescribeChangeSetOutput, error) {
+	cs, ok := m.changeSets[*input.ChangeSetName]
+	if !ok {
+		return nil, fmt.Errorf("change set %s not found", *input.ChangeSetName)
+	}
+	return cs, nil
+}
+
+func (m *mockNestedClient) GetTemplate(input *cf.GetTemplateInput) (*cf.GetTemplateOutput, error) {
+	key := cform.DerefString(input.ChangeSetName, cform.DerefString(input.StackName, ""))
+	body, ok := m.templates[key]
+	if !ok {
+		return nil, fmt.Errorf("template of %s not found", key)
+	}
+	return &cf.GetTemplateOutput{TemplateBody: aws.String(body)}, nil
+}
+
+// Test retrieval of the changes to the resources of nested stacks from their
+// change sets
+func TestDescribeNestedChanges(t *testing.T) {
+	change := func(action, id, typ, replacement, csID string) *cf.Change {
+		return &cf.Change{ResourceChange: &cf.ResourceChange{
+			Action:             aws.String(action),
+			LogicalResourceId:  aws.String(id),
+			PhysicalResourceId: aws.String(id + "-id"),
+			ResourceType:       aws.String(typ),
+			Replacement:        aws.String(replacement),
+			ChangeSetId:        aws.String(csID),
+		}}
+	}
+	mock := &mockNestedClient{
+		changeSets: map[string]*cf.DescribeChangeSetOutput{
+			"network-cs": {Changes: []*cf.Change{
+				change(cf.ChangeActionAdd, "Subnet", "AWS::EC2::Subnet", "", ""),
+				change(cf.ChangeActionModify, "Storage", "AWS::CloudFormation::Stack", cf.ReplacementFalse, "storage-cs"),
+			}},
+			"storage-cs": {Changes: []*cf.Change{
+				change(cf.ChangeActionModify, "Table", "AWS::DynamoDB::Table", cf.ReplacementTrue, ""),
+				change(cf.ChangeActionRemove, "Archive", "AWS::S3::Bucket", "", ""),
+			}},
+		},
+		templates: map[string]string{
+			"network-cs": "Resources:\n  Subnet:\n    Type: AWS::EC2::Subnet\n",
+			"storage-cs": "Resources:\n  Table:\n    Type: AWS::DynamoDB::Table\n",
+			"Storage-id": "Resources:\n  Archive:\n    Type: AWS::S3::Bucket\n    DeletionPolicy: Retain\n",
+			"Network-id": "Resources: {}\n",
+		},
+	}
+
+	changes := []cform.PlanChange{
+		{Action: cf.ChangeActionAdd, LogicalResourceID: "Bucket", ResourceType: "AWS::S3::Bucket"},
+		{Action: cf.ChangeActionModify, LogicalResourceID: "Network", PhysicalResourceID: "Network-id", ResourceType: "AWS::CloudFormation::Stack",
+			ChangeSetID: "network-cs"},
+	}
+	if err := describeNestedChanges(mock, changes, []string{"Network/Storage/Archive"}); err != nil {
+		t.Fatalf("Unexpected error (%s)", err)
+	}
+
+	var found []string
+	var walk func(changes []cform.PlanChange, indent string)
+	walk = func(changes []cform.PlanChange, indent string) {
+		for _, c := range changes {
+			found = append(found, fmt.Sprintf("%s%s %s %s", indent, c.Action, c.LogicalResourceID, c.Risk))
+			walk(c.NestedChanges, indent+"  ")
+		}
+	}
+	walk(changes, "")
+	expected := []string{
+		"Add Bucket ",
+		"Modify Network ",
+		"  Add Subnet ",
+		"  Modify Storage ",
+		"    Modify Table Replace",
+		"    Remove Archive Destroy",
+	}
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected (%s), Found (%s)", strings.Join(expected, "\n"), strings.Join(found, "\n"))
+	}
+
+	// A nested change set which cannot be described fails the plan
+	changes[1].NestedChanges = nil
+	changes[1].ChangeSetID = "missing-cs"
+	if err := describeNestedChanges(mock, changes, nil); err == nil {
+		t.Errorf("Expected error for missing nested change set")
+	}
+}
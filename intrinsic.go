@@ -0,0 +1,200 @@
+package cform
+
+import (
+	"fmt"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// IntrinsicForm defines how CloudFormation intrinsic functions are written to
+// the merged template.
+type IntrinsicForm int
+
+const (
+	// LongForm writes intrinsic functions using the `Fn::` syntax, e.g.
+	// `Fn::Sub: ...` and `Ref: ...`.
+	LongForm IntrinsicForm = iota
+
+	// ShortForm writes intrinsic functions using the YAML tag syntax, e.g.
+	// `!Sub ...` and `!Ref ...`.
+	ShortForm
+)
+
+// ParseIntrinsicForm returns the intrinsic function form for the input name
+// which is either "long" or "short".
+func ParseIntrinsicForm(name string) (IntrinsicForm, error) {
+	switch strings.ToLower(name) {
+	case "long":
+		return LongForm, nil
+	case "short":
+		return ShortForm, nil
+	}
+	return LongForm, fmt.Errorf("Unknown intrinsic function form: %s; Use long or short", name)
+}
+
+// intrinsicFunctions maps the YAML tag of each short form intrinsic function
+// to the key used by its long form.
+var intrinsicFunctions = map[string]string{
+	"!And":         "Fn::And",
+	"!Base64":      "Fn::Base64",
+	"!Cidr":        "Fn::Cidr",
+	"!Condition":   "Condition",
+	"!Equals":      "Fn::Equals",
+	"!FindInMap":   "Fn::FindInMap",
+	"!GetAZs":      "Fn::GetAZs",
+	"!GetAtt":      "Fn::GetAtt",
+	"!If":          "Fn::If",
+	"!ImportValue": "Fn::ImportValue",
+	"!Join":        "Fn::Join",
+	"!Not":         "Fn::Not",
+	"!Or":          "Fn::Or",
+	"!Ref":         "Ref",
+	"!Select":      "Fn::Select",
+	"!Split":       "Fn::Split",
+	"!Sub":         "Fn::Sub",
+	"!Transform":   "Fn::Transform",
+}
+
+// intrinsicTags maps the long form key of each intrinsic function to the YAML
+// tag of its short form.
+var intrinsicTags = func() map[string]string {
+	m := make(map[string]string)
+	for tag, key := range intrinsicFunctions {
+		m[key] = tag
+	}
+	return m
+}()
+
+// isLocalTag checks if the node has been explicitly tagged with a tag which is
+// not one of the standard YAML tags like `!!str`.
+func isLocalTag(n *yaml.Node) bool {
+	return strings.HasPrefix(n.Tag, "!") && !strings.HasPrefix(n.Tag, "!!")
+}
+
+// expandShortForm rewrites every short form intrinsic function in the node
+// tree to its long form, e.g. `!Ref Foo` becomes `Ref: Foo`.
+func expandShortForm(n *yaml.Node) error {
+	for _, c := range n.Content {
+		if err := expandShortForm(c); err != nil {
+			return err
+		}
+	}
+
+	if !isLocalTag(n) {
+		return nil
+	}
+
+	key, ok := intrinsicFunctions[n.Tag]
+	if !ok {
+		return fmt.Errorf("Unknown tag %s at line %d", n.Tag, n.Line)
+	}
+
+	value := *n
+	value.Tag = ""
+	value.Style &^= yaml.TaggedStyle
+	if value.Kind == yaml.ScalarNode {
+		// Arguments of short form functions are always strings, e.g. the
+		// argument of `!Ref 123` is "123".
+		value.Tag = "!!str"
+
+		// `!GetAtt Resource.Attribute` is equivalent to
+		// `Fn::GetAtt: [Resource, Attribute]`. Note that only the logical ID
+		// cannot contain a dot.
+		if key == "Fn::GetAtt" {
+			parts := strings.SplitN(value.Value, ".", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("Invalid !GetAtt argument %q at line %d", value.Value, n.Line)
+			}
+			value = yaml.Node{
+				Kind:        yaml.SequenceNode,
+				Tag:         "!!seq",
+				Line:        n.Line,
+				Column:      n.Column,
+				HeadComment: value.HeadComment,
+				LineComment: value.LineComment,
+				FootComment: value.FootComment,
+				Content: []*yaml.Node{
+					{Kind: yaml.ScalarNode, Tag: "!!str", Value: parts[0], Line: n.Line, Column: n.Column},
+					{Kind: yaml.ScalarNode, Tag: "!!str", Value: parts[1], Line: n.Line, Column: n.Column},
+				},
+			}
+		}
+	}
+
+	*n = yaml.Node{
+		Kind:   yaml.MappingNode,
+		Tag:    "!!map",
+		Line:   n.Line,
+		Column: n.Column,
+		Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: key, Line: n.Line, Column: n.Column},
+			&value,
+		},
+	}
+	return nil
+}
+
+// contractToShortForm rewrites every long form intrinsic function in the node
+// tree to its short form, e.g. `Ref: Foo` becomes `!Ref Foo`.
+//
+// A YAML node can have only one tag and hence an intrinsic function whose
+// argument is written in the short form retains the long form, e.g.
+// `Fn::Base64: !Sub ...`.
+func contractToShortForm(n *yaml.Node) {
+	for _, c := range n.Content {
+		contractToShortForm(c)
+	}
+
+	if n.Kind == yaml.MappingNode {
+		// A comment above the function name can only be written above the
+		// key of the function, e.g. `Foo:\n  # Comment\n  Ref: Bar`
+		for i := 0; i < len(n.Content); i += 2 {
+			if v := n.Content[i+1]; isLocalTag(v) && v.HeadComment != "" {
+				n.Content[i].HeadComment = joinComments(n.Content[i].HeadComment, v.HeadComment)
+				v.HeadComment = ""
+			}
+		}
+	}
+
+	if n.Kind != yaml.MappingNode || len(n.Content) != 2 {
+		return
+	}
+
+	key, value := n.Content[0], n.Content[1]
+	tag, ok := intrinsicTags[key.Value]
+	if !ok || key.Kind != yaml.ScalarNode || isLocalTag(value) {
+		return
+	}
+
+	if tag == "!GetAtt" && isGetAttPair(value) {
+		value = &yaml.Node{
+			Kind:        yaml.ScalarNode,
+			Value:       value.Content[0].Value + "." + value.Content[1].Value,
+			HeadComment: value.HeadComment,
+			LineComment: value.LineComment,
+			FootComment: value.FootComment,
+		}
+	}
+
+	// Keep the comments of the function name, e.g. `Ref: Foo # Comment`
+	c := *value
+	mergeComments(&c, n)
+	mergeComments(&c, key)
+	*n = c
+	n.Tag = tag
+}
+
+// isGetAttPair checks if the `Fn::GetAtt` argument is a list of a logical ID
+// and an attribute name which can be written as `!GetAtt Resource.Attribute`.
+func isGetAttPair(n *yaml.Node) bool {
+	if n.Kind != yaml.SequenceNode || len(n.Content) != 2 {
+		return false
+	}
+	for _, c := range n.Content {
+		if c.Kind != yaml.ScalarNode || isLocalTag(c) {
+			return false
+		}
+	}
+	return !strings.Contains(n.Content[0].Value, ".")
+}
@@ -0,0 +1,197 @@
+package cform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Format is the format of a template body.
+type Format int
+
+const (
+	// YAML template body
+	YAML Format = iota
+
+	// JSON template body
+	JSON
+)
+
+// ParseFormat returns the template format for the input name which is either
+// "yaml" or "json".
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "yaml", "yml":
+		return YAML, nil
+	case "json":
+		return JSON, nil
+	}
+	return YAML, fmt.Errorf("Unknown template format: %s; Use yaml or json", name)
+}
+
+// isJSON checks if the template source is a JSON document.
+func isJSON(source []byte) bool {
+	s := bytes.TrimSpace(source)
+	return len(s) > 0 && s[0] == '{' && json.Valid(s)
+}
+
+// unmarshalCfnJSON returns the root node of the JSON template source. The keys
+// of each JSON object retain their order in the source.
+func unmarshalCfnJSON(source []byte) (*yaml.Node, error) {
+	dec := json.NewDecoder(bytes.NewReader(source))
+	dec.UseNumber()
+	return decodeJSONNode(dec, source)
+}
+
+// decodeJSONNode decodes the next JSON value from the decoder into a node.
+func decodeJSONNode(dec *json.Decoder, source []byte) (*yaml.Node, error) {
+	line, col := jsonPosition(source, dec.InputOffset())
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &yaml.Node{Kind: yaml.ScalarNode, Line: line, Column: col}
+	switch v := tok.(type) {
+	case json.Delim:
+		if v == '{' {
+			n.Kind, n.Tag = yaml.MappingNode, "!!map"
+		} else {
+			n.Kind, n.Tag = yaml.SequenceNode, "!!seq"
+		}
+
+		for dec.More() {
+			if n.Kind == yaml.MappingNode {
+				key, err := decodeJSONNode(dec, source)
+				if err != nil {
+					return nil, err
+				}
+				n.Content = append(n.Content, key)
+			}
+
+			value, err := decodeJSONNode(dec, source)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, value)
+		}
+
+		// Closing delimiter
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	case string:
+		n.Tag, n.Value = "!!str", v
+	case json.Number:
+		n.Tag, n.Value = "!!int", v.String()
+		if strings.ContainsAny(n.Value, ".eE") {
+			n.Tag = "!!float"
+		}
+	case bool:
+		n.Tag, n.Value = "!!bool", fmt.Sprint(v)
+	case nil:
+		n.Tag, n.Value = "!!null", "null"
+	}
+	return n, nil
+}
+
+// jsonPosition returns the line and column of the JSON token which follows
+// the input offset of the source.
+func jsonPosition(source []byte, offset int64) (int, int) {
+	i := int(offset)
+	for i < len(source) && strings.IndexByte(" \t\r\n,:", source[i]) >= 0 {
+		i++
+	}
+	line := bytes.Count(source[:i], []byte("\n")) + 1
+	col := i - bytes.LastIndexByte(source[:i], '\n')
+	return line, col
+}
+
+// marshalCfnJSON returns the indented JSON representation of the node tree.
+func marshalCfnJSON(root *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeJSONNode(&buf, root, ""); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// writeJSONNode writes the JSON representation of the node to the buffer.
+// Dictionaries and lists are written with one entry per line and nested
+// entries are indented by two spaces.
+func writeJSONNode(buf *bytes.Buffer, n *yaml.Node, indent string) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		return writeJSONNode(buf, n.Content[0], indent)
+	case yaml.MappingNode, yaml.SequenceNode:
+		open, close, step := "[", "]", 1
+		if n.Kind == yaml.MappingNode {
+			open, close, step = "{", "}", 2
+		}
+
+		buf.WriteString(open)
+		for i := 0; i < len(n.Content); i += step {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString("\n" + indent + "  ")
+			if n.Kind == yaml.MappingNode {
+				key, err := marshalJSONValue(n.Content[i].Value)
+				if err != nil {
+					return err
+				}
+				buf.Write(key)
+				buf.WriteString(": ")
+			}
+			if err := writeJSONNode(buf, n.Content[i+step-1], indent+"  "); err != nil {
+				return err
+			}
+		}
+		if len(n.Content) > 0 {
+			buf.WriteString("\n" + indent)
+		}
+		buf.WriteString(close)
+		return nil
+	}
+
+	d, err := jsonScalar(n)
+	if err != nil {
+		return fmt.Errorf("Cannot write %q at line %d as JSON: %s", n.Value, n.Line, err.Error())
+	}
+	buf.Write(d)
+	return nil
+}
+
+// jsonScalar returns the JSON representation of the scalar node based on its
+// resolved tag. Integers, floats and booleans are written as JSON literals
+// only if their text in the source is valid JSON and nulls are always written
+// as `null`. Any other scalar, e.g. a timestamp like an unquoted
+// `2010-09-09` or an octal integer like `0123`, is written as its text in the
+// source since YAML and JSON read such values differently.
+func jsonScalar(n *yaml.Node) ([]byte, error) {
+	switch n.ShortTag() {
+	case "!!null":
+		return []byte("null"), nil
+	case "!!int", "!!float", "!!bool":
+		if json.Valid([]byte(n.Value)) {
+			return []byte(n.Value), nil
+		}
+	}
+	return marshalJSONValue(n.Value)
+}
+
+// marshalJSONValue returns the JSON encoding of the value without escaping
+// HTML characters like `<` which are common in templates, e.g. in user data.
+func marshalJSONValue(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
@@ -0,0 +1,398 @@
+package cform
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	cf "github.com/aws/aws-sdk-go/service/cloudformation"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// TemplateParameter is a parameter declared in the `Parameters` section of
+// the template.
+type TemplateParameter struct {
+	Name string
+	// Type of the parameter, e.g. `String` or `AWS::EC2::VPC::Id`
+	Type string
+	// Default value of the parameter; nil if the parameter has no default
+	Default *string
+	// Whether the value of the parameter is masked
+	NoEcho bool
+	// Constraints on the value of the parameter
+	AllowedValues         []string
+	AllowedPattern        string
+	MinLength, MaxLength  *int
+	MinValue, MaxValue    *float64
+	ConstraintDescription string
+	// Location of the parameter in the template sources
+	Source SourceLocation
+}
+
+// Parameters returns the parameters declared by the template in the order in
+// which they are written.
+func (t *Template) Parameters() []TemplateParameter {
+	s, ok := t.sections["Parameters"]
+	if !ok || s.entries == nil {
+		return nil
+	}
+
+	var params []TemplateParameter
+	for _, k := range s.keys {
+		e := s.entries[k]
+		p := TemplateParameter{Name: k, Source: e.source}
+		for i := 0; e.value.Kind == yaml.MappingNode && i < len(e.value.Content); i += 2 {
+			v := e.value.Content[i+1]
+			switch e.value.Content[i].Value {
+			case "Type":
+				p.Type = v.Value
+			case "Default":
+				d := v.Value
+				p.Default = &d
+			case "NoEcho":
+				p.NoEcho = v.Value == "true"
+			case "AllowedValues":
+				for _, c := range v.Content {
+					p.AllowedValues = append(p.AllowedValues, c.Value)
+				}
+			case "AllowedPattern":
+				p.AllowedPattern = v.Value
+			case "MinLength":
+				p.MinLength = parseInt(v.Value)
+			case "MaxLength":
+				p.MaxLength = parseInt(v.Value)
+			case "MinValue":
+				p.MinValue = parseFloat(v.Value)
+			case "MaxValue":
+				p.MaxValue = parseFloat(v.Value)
+			case "ConstraintDescription":
+				p.ConstraintDescription = v.Value
+			}
+		}
+		params = append(params, p)
+	}
+	return params
+}
+
+// awsParameterFormats are the formats of the values of the AWS-specific
+// parameter types which have a well-known format. The values of the other
+// AWS-specific types are not checked.
+var awsParameterFormats = map[string]*regexp.Regexp{
+	"AWS::EC2::Image::Id":          regexp.MustCompile(`^ami-[0-9a-f]{8,17}$`),
+	"AWS::EC2::Instance::Id":       regexp.MustCompile(`^i-[0-9a-f]{8,17}$`),
+	"AWS::EC2::SecurityGroup::Id":  regexp.MustCompile(`^sg-[0-9a-f]{8,17}$`),
+	"AWS::EC2::Subnet::Id":         regexp.MustCompile(`^subnet-[0-9a-f]{8,17}$`),
+	"AWS::EC2::Volume::Id":         regexp.MustCompile(`^vol-[0-9a-f]{8,17}$`),
+	"AWS::EC2::VPC::Id":            regexp.MustCompile(`^vpc-[0-9a-f]{8,17}$`),
+	"AWS::Route53::HostedZone::Id": regexp.MustCompile(`^Z[0-9A-Z]{1,32}$`),
+}
+
+// Validate checks if the value satisfies the type and the constraints of the
+// parameter. Values of list types are checked item by item.
+//
+// The allowed pattern is matched against the whole value using Go regular
+// expressions; a pattern which cannot be compiled as such, e.g. one that uses
+// lookaheads, is not checked.
+func (p TemplateParameter) Validate(value string) error {
+	reason := p.violation(value)
+	if reason == "" {
+		return nil
+	}
+
+	if p.NoEcho {
+		value = "****"
+	}
+	msg := fmt.Sprintf("Invalid value %q for parameter %s (%s): %s", value, p.Name, p.Source, reason)
+	if p.ConstraintDescription != "" {
+		msg += "; " + p.ConstraintDescription
+	}
+	return errors.New(msg)
+}
+
+// violation returns the reason why the value does not satisfy the parameter
+// type or constraints; an empty string if it does.
+func (p TemplateParameter) violation(value string) string {
+	itemType := p.Type
+	items := []string{value}
+	switch {
+	case p.Type == "CommaDelimitedList":
+		itemType = "String"
+		items = splitList(value)
+	case strings.HasPrefix(p.Type, "List<") && strings.HasSuffix(p.Type, ">"):
+		itemType = p.Type[len("List<") : len(p.Type)-1]
+		items = splitList(value)
+	}
+
+	for _, item := range items {
+		if reason := p.itemViolation(itemType, item); reason != "" {
+			if len(items) > 1 {
+				return fmt.Sprintf("item %q: %s", item, reason)
+			}
+			return reason
+		}
+	}
+	return ""
+}
+
+// itemViolation returns the reason why a value, or an item of a list value,
+// does not satisfy the parameter type or constraints. Like CloudFormation, the
+// minimum and maximum values are only checked for numbers and the allowed
+// pattern and the minimum and maximum lengths only for strings.
+func (p TemplateParameter) itemViolation(itemType, value string) string {
+	if itemType == "Number" {
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "must be a number"
+		}
+		if p.MinValue != nil && n < *p.MinValue {
+			return fmt.Sprintf("must be at least %v", *p.MinValue)
+		}
+		if p.MaxValue != nil && n > *p.MaxValue {
+			return fmt.Sprintf("must be at most %v", *p.MaxValue)
+		}
+	}
+	if f, ok := awsParameterFormats[itemType]; ok && !f.MatchString(value) {
+		return fmt.Sprintf("must be a valid %s", itemType)
+	}
+
+	if len(p.AllowedValues) > 0 && indexOf(p.AllowedValues, value) < 0 {
+		return fmt.Sprintf("must be one of %s", strings.Join(p.AllowedValues, ", "))
+	}
+	if itemType != "String" {
+		return ""
+	}
+
+	if p.AllowedPattern != "" {
+		if re, err := regexp.Compile("^(?:" + p.AllowedPattern + ")$"); err == nil && !re.MatchString(value) {
+			return fmt.Sprintf("must match pattern %s", p.AllowedPattern)
+		}
+	}
+
+	n := utf8.RuneCountInString(value)
+	if p.MinLength != nil && n < *p.MinLength {
+		return fmt.Sprintf("must have at least %d characters", *p.MinLength)
+	}
+	if p.MaxLength != nil && n > *p.MaxLength {
+		return fmt.Sprintf("must have at most %d characters", *p.MaxLength)
+	}
+	return ""
+}
+
+// splitList returns the items of a comma separated list value.
+func splitList(value string) []string {
+	items := strings.Split(value, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items
+}
+
+func parseInt(s string) *int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return nil
+	}
+	return &n
+}
+
+func parseFloat(s string) *float64 {
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil
+	}
+	return &n
+}
+
+// ParameterValue is the value of a template parameter in a stack config.
+//
+// The value can refer to environment variables as `${env:NAME}` and can be
+// read from a file as `file://path`, where a relative path is relative to the
+// directory of the stack config. A parameter whose previous value is retained
+// is written as `{UsePreviousValue: true}`.
+type ParameterValue struct {
+	Value            string `yaml:"Value,omitempty"`
+	UsePreviousValue bool   `yaml:"UsePreviousValue,omitempty"`
+
+	// Directory relative to which `file://` paths are read
+	dir string
+}
+
+// UnmarshalYAML reads the parameter value which is either a string or a
+// dictionary.
+func (v *ParameterValue) UnmarshalYAML(n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		v.Value = n.Value
+		return nil
+	case yaml.MappingNode:
+		for i := 0; i < len(n.Content); i += 2 {
+			k, value := n.Content[i], n.Content[i+1]
+			switch k.Value {
+			case "Value":
+				v.Value = value.Value
+			case "UsePreviousValue":
+				if err := value.Decode(&v.UsePreviousValue); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("line %d: Unknown parameter setting %s", k.Line, k.Value)
+			}
+		}
+		if v.UsePreviousValue && v.Value != "" {
+			return fmt.Errorf("line %d: Parameter cannot have both a Value and UsePreviousValue", n.Line)
+		}
+		return nil
+	}
+	return fmt.Errorf("line %d: Parameter value must be a string or a dictionary", n.Line)
+}
+
+// MarshalYAML writes the parameter value as a string unless the previous
+// value is retained.
+func (v ParameterValue) MarshalYAML() (interface{}, error) {
+	if v.UsePreviousValue {
+		return map[string]bool{"UsePreviousValue": true}, nil
+	}
+	return v.Value, nil
+}
+
+// envReference matches the references to environment variables in parameter
+// values, e.g. `${env:HOME}`.
+var envReference = regexp.MustCompile(`\$\{env:([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// resolve returns the value of the parameter after replacing the references
+// to environment variables and reading the file which contains the value.
+func (v ParameterValue) resolve() (string, error) {
+	var err error
+	value := envReference.ReplaceAllStringFunc(v.Value, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("Environment variable %s is not set", name)
+		}
+		return env
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(value, "file://") {
+		path := strings.TrimPrefix(value, "file://")
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(v.dir, path)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		value = string(b)
+	}
+	return value, nil
+}
+
+// ParseParameterOverrides parses parameter values written as `Key=Value`,
+// e.g. those passed on the command line. File paths are relative to the
+// working directory.
+func ParseParameterOverrides(overrides []string) (map[string]ParameterValue, error) {
+	params := make(map[string]ParameterValue)
+	for _, o := range overrides {
+		i := strings.Index(o, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid parameter %s; Use Key=Value", o)
+		}
+		params[o[:i]] = ParameterValue{Value: o[i+1:]}
+	}
+	return params, nil
+}
+
+// OverrideParameters overrides the values of the parameters in the config.
+func (c *StackConfig) OverrideParameters(params map[string]ParameterValue) {
+	c.Parameters = overrideParameters(c.Parameters, params)
+}
+
+// ResolveParameters returns the values of the template parameters passed to
+// CloudFormation.
+//
+// The value of a parameter is taken from the stack config, whose values are
+// overridden by the environment config and the command line, and otherwise
+// from the default value of the parameter in the template. It is an error if
+// a parameter has neither, or if the config has a value for a parameter which
+// the template does not declare. The values, including the default values
+// which are used, are validated against the parameter constraints and all the
+// invalid values are reported together.
+func (c *StackConfig) ResolveParameters(declared []TemplateParameter) ([]*cf.Parameter, error) {
+	var params []*cf.Parameter
+	var missing, invalid []string
+	isDeclared := make(map[string]bool)
+
+	for _, d := range declared {
+		isDeclared[d.Name] = true
+
+		v, ok := c.Parameters[d.Name]
+		if !ok {
+			if d.Default == nil {
+				missing = append(missing, fmt.Sprintf("%s (%s)", d.Name, d.Source))
+			} else if err := d.Validate(*d.Default); err != nil {
+				invalid = append(invalid, err.Error())
+			}
+			continue
+		}
+
+		p := &cf.Parameter{ParameterKey: aws.String(d.Name)}
+		if v.UsePreviousValue {
+			p.UsePreviousValue = aws.Bool(true)
+		} else {
+			value, err := v.resolve()
+			if err != nil {
+				return nil, fmt.Errorf("Cannot resolve parameter %s: %s", d.Name, err.Error())
+			}
+			if err := d.Validate(value); err != nil {
+				invalid = append(invalid, err.Error())
+			}
+			p.ParameterValue = aws.String(value)
+		}
+		params = append(params, p)
+	}
+
+	var undeclared []string
+	for k := range c.Parameters {
+		if !isDeclared[k] {
+			undeclared = append(undeclared, k)
+		}
+	}
+	sort.Strings(undeclared)
+
+	switch {
+	case len(invalid) > 0:
+		return nil, errors.New(strings.Join(invalid, "\n"))
+	case len(missing) > 0:
+		return nil, fmt.Errorf("Parameters without a value or a default: %s", strings.Join(missing, ", "))
+	case len(undeclared) > 0:
+		return nil, fmt.Errorf("Parameters not declared in the template: %s", strings.Join(undeclared, ", "))
+	}
+	return params, nil
+}
+
+// overrideParameters returns the parameter values overridden by another set
+// of parameter values.
+func overrideParameters(m, other map[string]ParameterValue) map[string]ParameterValue {
+	if len(other) == 0 {
+		return m
+	}
+
+	merged := make(map[string]ParameterValue)
+	for k, v := range m {
+		merged[k] = v
+	}
+	for k, v := range other {
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,261 @@
+package cform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func newParametersTemplate(t *testing.T) *Template {
+	var d = format(`
+	Parameters:
+		Env:
+			Type: String
+		InstanceType:
+			Type: String
+			Default: t3.micro
+		Password:
+			Type: String
+			NoEcho: true
+		Port:
+			Type: Number
+			Default: 8080
+	`)
+
+	tmpl := NewTemplate(MergeOptions{})
+	if err := tmpl.Add("params.yml", []byte(d)); err != nil {
+		t.Fatalf("Failed to create template: %s", err)
+	}
+	return tmpl
+}
+
+func TestTemplateParameters(t *testing.T) {
+	params := newParametersTemplate(t).Parameters()
+
+	var found []string
+	for _, p := range params {
+		s := p.Name + "@" + p.Source.String()
+		if p.Default != nil {
+			s += "=" + *p.Default
+		}
+		found = append(found, s)
+	}
+
+	expected := "Env@params.yml:2 InstanceType@params.yml:4=t3.micro Password@params.yml:7 Port@params.yml:10=8080"
+	if strings.Join(found, " ") != expected {
+		t.Errorf("Expected (%s), Found (%s)", expected, strings.Join(found, " "))
+	}
+}
+
+func TestResolveParameters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cform")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"base.yml": format(`
+		Parameters:
+			Env: dev
+			InstanceType: t3.small
+			Password: file://secrets/password.txt
+		`),
+		"prod.yml": format(`
+		Extends: base.yml
+		Parameters:
+			Env: ${env:CFORM_TEST_ENV}
+			Port: {UsePreviousValue: true}
+		`),
+		"secrets/password.txt": "s3cr3t",
+	}
+	for name, body := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %s", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(body), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err)
+		}
+	}
+
+	c, err := ReadStackConfig(filepath.Join(dir, "prod.yml"))
+	if err != nil {
+		t.Fatalf("Failed to read stack config: %s", err)
+	}
+
+	overrides, err := ParseParameterOverrides([]string{"InstanceType=m5.large=x"})
+	if err != nil {
+		t.Fatalf("Failed to parse parameters: %s", err)
+	}
+	c.OverrideParameters(overrides)
+
+	tmpl := newParametersTemplate(t)
+
+	os.Unsetenv("CFORM_TEST_ENV")
+	if _, err := c.ResolveParameters(tmpl.Parameters()); err == nil || !strings.Contains(err.Error(), "CFORM_TEST_ENV is not set") {
+		t.Errorf("Expected error for unset environment variable, Found (%v)", err)
+	}
+
+	os.Setenv("CFORM_TEST_ENV", "prod")
+	defer os.Unsetenv("CFORM_TEST_ENV")
+
+	params, err := c.ResolveParameters(tmpl.Parameters())
+	if err != nil {
+		t.Fatalf("Failed to resolve parameters: %s", err)
+	}
+
+	var found []string
+	for _, p := range params {
+		if aws.BoolValue(p.UsePreviousValue) {
+			found = append(found, *p.ParameterKey+"=<previous>")
+		} else {
+			found = append(found, *p.ParameterKey+"="+*p.ParameterValue)
+		}
+	}
+
+	expected := "Env=prod InstanceType=m5.large=x Password=s3cr3t Port=<previous>"
+	if strings.Join(found, " ") != expected {
+		t.Errorf("Expected (%s), Found (%s)", expected, strings.Join(found, " "))
+	}
+}
+
+func TestResolveParametersErrors(t *testing.T) {
+	tmpl := newParametersTemplate(t)
+
+	c := &StackConfig{Parameters: map[string]ParameterValue{"Env": {Value: "dev"}}}
+	_, err := c.ResolveParameters(tmpl.Parameters())
+	expected := "Parameters without a value or a default: Password (params.yml:7)"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected (%s), Found (%v)", expected, err)
+	}
+
+	c.Parameters["Password"] = ParameterValue{Value: "secret"}
+	c.Parameters["Region"] = ParameterValue{Value: "eu-west-1"}
+	_, err = c.ResolveParameters(tmpl.Parameters())
+	expected = "Parameters not declared in the template: Region"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected (%s), Found (%v)", expected, err)
+	}
+
+	if _, err := ParseParameterOverrides([]string{"=value"}); err == nil {
+		t.Errorf("Expected error for parameter without a name")
+	}
+
+	if _, err := ParseStackConfig([]byte("Parameters:\n  Env: {Value: dev, UsePreviousValue: true}\n")); err == nil {
+		t.Errorf("Expected error for parameter with a value and UsePreviousValue")
+	}
+}
+
+func TestValidateParameters(t *testing.T) {
+	var d = format(`
+	Parameters:
+		InstanceType:
+			Type: String
+			AllowedValues: [t3.micro, t3.small]
+			ConstraintDescription: must be a small instance type
+		Cidr:
+			Type: String
+			AllowedPattern: "(\\d{1,3})\\.(\\d{1,3})\\.(\\d{1,3})\\.(\\d{1,3})/(\\d{1,2})"
+		Name:
+			Type: String
+			MinLength: 3
+			MaxLength: "5"
+		Port:
+			Type: Number
+			MinValue: 1024
+			MaxValue: 65535
+		Ports:
+			Type: List<Number>
+			MaxValue: 100
+		Zones:
+			Type: CommaDelimitedList
+			AllowedValues: [a, b]
+		Vpc:
+			Type: AWS::EC2::VPC::Id
+		Subnets:
+			Type: List<AWS::EC2::Subnet::Id>
+		Password:
+			Type: String
+			NoEcho: true
+			MinLength: 8
+		Count:
+			Type: Number
+			AllowedPattern: "[a-z]+"
+			MaxLength: 2
+		Label:
+			Type: String
+			MaxValue: 10
+		Size:
+			Type: Number
+			MinValue: 10
+			Default: 5
+	`)
+
+	tmpl := NewTemplate(MergeOptions{})
+	if err := tmpl.Add("params.yml", []byte(d)); err != nil {
+		t.Fatalf("Failed to create template: %s", err)
+	}
+	params := make(map[string]TemplateParameter)
+	for _, p := range tmpl.Parameters() {
+		params[p.Name] = p
+	}
+
+	tests := []struct {
+		name, value, expected string
+	}{
+		{"InstanceType", "t3.small", ""},
+		{"InstanceType", "m5.large", `Invalid value "m5.large" for parameter InstanceType (params.yml:2): must be one of t3.micro, t3.small; must be a small instance type`},
+		{"Cidr", "10.0.0.0/16", ""},
+		{"Cidr", "10.0.0.0/16 ", `must match pattern`},
+		{"Name", "abc", ""},
+		{"Name", "ab", "must have at least 3 characters"},
+		{"Name", "abcdef", "must have at most 5 characters"},
+		{"Port", "8080", ""},
+		{"Port", "80", "must be at least 1024"},
+		{"Port", "http", "must be a number"},
+		{"Ports", "10, 20", ""},
+		{"Ports", "10,200", `item "200": must be at most 100`},
+		{"Zones", "a,b", ""},
+		{"Zones", "a,c", `item "c": must be one of a, b`},
+		{"Vpc", "vpc-0123456789abcdef0", ""},
+		{"Vpc", "subnet-0123abcd", "must be a valid AWS::EC2::VPC::Id"},
+		{"Subnets", "subnet-0123abcd,subnet-4567cdef", ""},
+		{"Subnets", "subnet-0123abcd,sg-4567cdef", `item "sg-4567cdef": must be a valid AWS::EC2::Subnet::Id`},
+		{"Password", "short", `Invalid value "****" for parameter Password`},
+		{"Count", "1000", ""},
+		{"Label", "100", ""},
+	}
+
+	for _, test := range tests {
+		err := params[test.name].Validate(test.value)
+		switch {
+		case test.expected == "" && err != nil:
+			t.Errorf("Unexpected error for %s=%s (%s)", test.name, test.value, err)
+		case test.expected != "" && (err == nil || !strings.Contains(err.Error(), test.expected)):
+			t.Errorf("Expected (%s), Found (%v)", test.expected, err)
+		}
+	}
+
+	c := &StackConfig{Parameters: map[string]ParameterValue{
+		"InstanceType": {Value: "m5.large"},
+		"Cidr":         {Value: "10.0.0.0/16"},
+		"Name":         {Value: "ab"},
+		"Port":         {Value: "8080"},
+		"Ports":        {Value: "1"},
+		"Zones":        {Value: "a"},
+		"Vpc":          {UsePreviousValue: true},
+		"Subnets":      {Value: "subnet-0123abcd"},
+		"Password":     {Value: "secret-password"},
+		"Count":        {Value: "1"},
+		"Label":        {Value: "a"},
+	}}
+	_, err := c.ResolveParameters(tmpl.Parameters())
+	if err == nil || strings.Count(err.Error(), "Invalid value") != 3 || !strings.Contains(err.Error(), `"5" for parameter Size`) {
+		t.Errorf("Expected errors for InstanceType, Name and the default of Size, Found (%v)", err)
+	}
+}
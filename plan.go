@@ -0,0 +1,381 @@
+package cform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	cf "github.com/aws/aws-sdk-go/service/cloudformation"
+	cfi "github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// PlanVersion is the version of the plan file format written by this version
+// of cform.
+const PlanVersion = 1
+
+// Plan is the execution plan of a stack operation which is determined using
+// a change set. A plan is saved to a file so that the change set which was
+// reviewed is the one which is executed.
+type Plan struct {
+	// Version of the plan file format
+	Version int
+	// Name and ID of the stack
+	StackName string
+	StackID   string
+	// Time at which the stack was last updated when the plan was determined;
+	// nil if the stack was created for the change set or never updated
+	StackLastUpdatedTime *time.Time `json:",omitempty"`
+	// ARN, name and type (`CREATE` or `UPDATE`) of the change set
+	ChangeSetID   string
+	ChangeSetName string
+	ChangeSetType string
+	// SHA-256 checksum of the deployed template of the stack when the plan
+	// was determined; empty if the stack was created for the change set
+	TemplateHash string
+	// Parameter values of the change set
+	Parameters []PlanParameter `json:",omitempty"`
+	// Capabilities acknowledged by the change set
+	Capabilities []string `json:",omitempty"`
+	// Stack settings which are not part of the change set and hence are set
+	// once the change set has been executed successfully
+	TerminationProtection *bool  `json:",omitempty"`
+	StackPolicyBody       string `json:",omitempty"`
+	// Changes to the resources of the stack
+	Changes []PlanChange `json:",omitempty"`
+}
+
+// PlanParameter is the value of a template parameter in a plan. The values of
+// `NoEcho` parameters are masked.
+type PlanParameter struct {
+	Name             string
+	Value            string `json:",omitempty"`
+	UsePreviousValue bool   `json:",omitempty"`
+}
+
+// PlanChange is a change to a resource of the stack.
+type PlanChange struct {
+	Action             string
+	LogicalResourceID  string
+	PhysicalResourceID string `json:",omitempty"`
+	ResourceType       string
+	Replacement        string `json:",omitempty"`
+	// Attributes of the resource which are changed, e.g. `Properties`
+	Scope []string `json:",omitempty"`
+	// Location of the resource in the template sources
+	Source string `json:",omitempty"`
+	// Changes to the attributes of a modified resource
+	Details []PlanChangeDetail `json:",omitempty"`
+	// Risk of the change if it may lose data, i.e. `Replace` or `Destroy`,
+	// and the reason
+	Risk       string `json:",omitempty"`
+	RiskReason string `json:",omitempty"`
+	// ARN of the change set of a nested stack and the changes to the
+	// resources of the nested stack
+	ChangeSetID   string       `json:",omitempty"`
+	NestedChanges []PlanChange `json:",omitempty"`
+}
+
+// PlanChangeDetail is a change to an attribute of a resource, e.g. to one of
+// its properties, along with the reason why it changes.
+type PlanChangeDetail struct {
+	// Changed attribute, e.g. `Properties` or `Tags`, and the name of the
+	// property if a property is changed
+	Attribute string
+	Name      string `json:",omitempty"`
+	// Whether the change requires the resource to be recreated: `Never`,
+	// `Conditionally` or `Always`
+	RequiresRecreation string `json:",omitempty"`
+	// Whether the change is certain (`Static`) or can be determined only
+	// during the stack operation (`Dynamic`)
+	Evaluation string `json:",omitempty"`
+	// Cause of the change, e.g. `DirectModification` or `ResourceReference`,
+	// and the entity which caused it, e.g. the referenced resource
+	ChangeSource  string `json:",omitempty"`
+	CausingEntity string `json:",omitempty"`
+	// Compact JSON values of the property in the deployed template and in the
+	// new template; empty if the property is not defined
+	OldValue string `json:",omitempty"`
+	NewValue string `json:",omitempty"`
+}
+
+// PlanSummary is the number of resources of a plan which are added, modified
+// and removed, including the resources of nested stacks.
+type PlanSummary struct {
+	Add    int
+	Modify int
+	Remove int
+	// Modified resources which are replaced or may be replaced
+	Replace int
+}
+
+// Summary returns the number of resources of the plan which are added,
+// modified and removed.
+func (p *Plan) Summary() PlanSummary {
+	return SummarizeChanges(p.Changes)
+}
+
+// SummarizeChanges returns the number of resources which are added, modified
+// and removed by the changes and the changes to their nested stacks.
+func SummarizeChanges(changes []PlanChange) PlanSummary {
+	var s PlanSummary
+	for _, c := range changes {
+		nested := SummarizeChanges(c.NestedChanges)
+		s.Add += nested.Add
+		s.Modify += nested.Modify
+		s.Remove += nested.Remove
+		s.Replace += nested.Replace
+
+		switch c.Action {
+		case cf.ChangeActionAdd:
+			s.Add++
+		case cf.ChangeActionModify:
+			s.Modify++
+			if c.Replacement == cf.ReplacementTrue || c.Replacement == cf.ReplacementConditional {
+				s.Replace++
+			}
+		case cf.ChangeActionRemove:
+			s.Remove++
+		}
+	}
+	return s
+}
+
+// String returns the summary as a sentence, e.g. `3 to add, 2 to change (1
+// replacement), 1 to destroy`.
+func (s PlanSummary) String() string {
+	change := fmt.Sprintf("%d to change", s.Modify)
+	if s.Replace == 1 {
+		change += " (1 replacement)"
+	} else if s.Replace > 1 {
+		change += fmt.Sprintf(" (%d replacements)", s.Replace)
+	}
+	return fmt.Sprintf("%d to add, %s, %d to destroy", s.Add, change, s.Remove)
+}
+
+// PlanParameters returns the parameter values of a plan. The values of the
+// parameters declared with `NoEcho` are masked.
+func PlanParameters(params []*cf.Parameter, declared []TemplateParameter) []PlanParameter {
+	noEcho := make(map[string]bool)
+	for _, p := range declared {
+		noEcho[p.Name] = p.NoEcho
+	}
+
+	var planParams []PlanParameter
+	for _, p := range params {
+		pp := PlanParameter{Name: *p.ParameterKey, UsePreviousValue: aws.BoolValue(p.UsePreviousValue)}
+		if !pp.UsePreviousValue {
+			pp.Value = DerefString(p.ParameterValue, "")
+			if noEcho[pp.Name] {
+				pp.Value = "****"
+			}
+		}
+		planParams = append(planParams, pp)
+	}
+	return planParams
+}
+
+// PlanChanges returns the changes to the resources described by the change
+// set along with the location of the resources in the template sources.
+//
+// The old and new values of the changed properties of modified resources are
+// found by comparing the deployed template of the stack, if any, with the new
+// template, if any.
+func PlanChanges(cs *cf.DescribeChangeSetOutput, tmpl, deployed *Template) []PlanChange {
+	var sources SourceMap
+	if tmpl != nil {
+		sources = tmpl.Sources()
+	}
+
+	var changes []PlanChange
+	for _, change := range cs.Changes {
+		rs := change.ResourceChange
+		if rs == nil {
+			continue
+		}
+
+		c := PlanChange{
+			Action:             DerefString(rs.Action, ""),
+			LogicalResourceID:  DerefString(rs.LogicalResourceId, ""),
+			PhysicalResourceID: DerefString(rs.PhysicalResourceId, ""),
+			ResourceType:       DerefString(rs.ResourceType, ""),
+			Replacement:        DerefString(rs.Replacement, ""),
+			Scope:              aws.StringValueSlice(rs.Scope),
+			ChangeSetID:        DerefString(rs.ChangeSetId, ""),
+		}
+		if l, ok := sources.Entry("Resources", c.LogicalResourceID); ok {
+			c.Source = l.String()
+		}
+
+		for _, d := range rs.Details {
+			if d.Target == nil {
+				continue
+			}
+			detail := PlanChangeDetail{
+				Attribute:          DerefString(d.Target.Attribute, ""),
+				Name:               DerefString(d.Target.Name, ""),
+				RequiresRecreation: DerefString(d.Target.RequiresRecreation, ""),
+				Evaluation:         DerefString(d.Evaluation, ""),
+				ChangeSource:       DerefString(d.ChangeSource, ""),
+				CausingEntity:      DerefString(d.CausingEntity, ""),
+			}
+
+			// Tags are changed using the `Tags` property
+			property := detail.Name
+			if detail.Attribute == cf.ResourceAttributeTags {
+				property = "Tags"
+			} else if detail.Attribute != cf.ResourceAttributeProperties {
+				property = ""
+			}
+			if c.Action == cf.ChangeActionModify && deployed != nil && property != "" {
+				detail.OldValue = deployed.resourceProperty(c.LogicalResourceID, property)
+				detail.NewValue = tmpl.resourceProperty(c.LogicalResourceID, property)
+			}
+			c.Details = append(c.Details, detail)
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// resource returns the definition of the resource or nil if the template,
+// which may be nil, does not define the resource.
+func (t *Template) resource(logicalID string) *yaml.Node {
+	if t == nil {
+		return nil
+	}
+	s, ok := t.sections["Resources"]
+	if !ok || s.entries == nil {
+		return nil
+	}
+	e, ok := s.entries[logicalID]
+	if !ok {
+		return nil
+	}
+	return e.value
+}
+
+// resourceAttribute returns the scalar value of the attribute of the resource,
+// e.g. its `DeletionPolicy`, or an empty string if it is not defined.
+func (t *Template) resourceAttribute(logicalID, name string) string {
+	r := t.resource(logicalID)
+	if r == nil {
+		return ""
+	}
+	if value := mappingValue(r, name); value != nil && value.Kind == yaml.ScalarNode {
+		return value.Value
+	}
+	return ""
+}
+
+// resourceProperty returns the compact JSON value of the property of the
+// resource or an empty string if the resource or the property is not defined.
+func (t *Template) resourceProperty(logicalID, name string) string {
+	r := t.resource(logicalID)
+	if r == nil {
+		return ""
+	}
+	props := mappingValue(r, "Properties")
+	if props == nil {
+		return ""
+	}
+	value := mappingValue(props, name)
+	if value == nil {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	if err := writeJSONNode(&buf, value, ""); err != nil {
+		return ""
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, buf.Bytes()); err != nil {
+		return buf.String()
+	}
+	return compact.String()
+}
+
+// HasNestedStacks checks if the template has nested stacks, i.e. resources of
+// the type `AWS::CloudFormation::Stack`.
+func (t *Template) HasNestedStacks() bool {
+	s, ok := t.sections["Resources"]
+	if !ok || s.entries == nil {
+		return false
+	}
+	for _, e := range s.entries {
+		if typ := mappingValue(e.value, "Type"); typ != nil && typ.Value == "AWS::CloudFormation::Stack" {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadPlan reads the plan saved to the file.
+func ReadPlan(path string) (*Plan, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Plan{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("%s: Invalid plan: %s", path, err.Error())
+	}
+	if p.Version != PlanVersion {
+		return nil, fmt.Errorf("%s: Unsupported plan version %d", path, p.Version)
+	}
+	if p.StackName == "" || p.ChangeSetID == "" {
+		return nil, fmt.Errorf("%s: Plan does not have a stack or a change set", path)
+	}
+	return p, nil
+}
+
+// Write saves the plan to the file.
+func (p *Plan) Write(path string) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// Verify checks that the stack of the plan has been neither updated nor
+// deleted and that its deployed template has not changed since the plan was
+// determined. The template and the parameters of a change set cannot change,
+// hence executing the change set makes exactly the changes in the plan.
+func (p *Plan) Verify(svc cfi.CloudFormationAPI) error {
+	stack, err := DescribeStack(svc, p.StackID)
+	if err != nil {
+		return err
+	}
+	// Stacks which have been deleted are described when using their ID
+	if stack == nil || DerefString(stack.StackStatus, "") == cf.StackStatusDeleteComplete {
+		return fmt.Errorf("Stack %s has been deleted since the plan", p.StackName)
+	}
+	if !sameTime(stack.LastUpdatedTime, p.StackLastUpdatedTime) {
+		return fmt.Errorf("Stack %s has been updated since the plan", p.StackName)
+	}
+
+	if p.TemplateHash == "" {
+		return nil
+	}
+	hash, err := DeployedTemplateHash(svc, p.StackID)
+	if err != nil {
+		return err
+	}
+	if hash != p.TemplateHash {
+		return fmt.Errorf("Template of stack %s has changed since the plan", p.StackName)
+	}
+	return nil
+}
+
+// sameTime checks if both times are nil or equal.
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -0,0 +1,226 @@
+package cform
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	cf "github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+func TestPlanFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cform")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	lastUpdated := time.Date(2017, 1, 7, 23, 31, 1, 0, time.UTC)
+	p := &Plan{
+		Version:              PlanVersion,
+		StackName:            "test-stack",
+		StackID:              "test-stack-id",
+		StackLastUpdatedTime: &lastUpdated,
+		ChangeSetID:          "testcs-id",
+		ChangeSetName:        "testcs",
+		ChangeSetType:        cf.ChangeSetTypeUpdate,
+		TemplateHash:         Checksum([]byte("Resources: {}\n")),
+		Parameters:           []PlanParameter{{Name: "Env", Value: "prod"}},
+		Capabilities:         []string{cf.CapabilityCapabilityIam},
+		Changes:              []PlanChange{{Action: "Add", LogicalResourceID: "Bucket", ResourceType: "AWS::S3::Bucket"}},
+	}
+
+	path := filepath.Join(dir, "plan.cform")
+	if err := p.Write(path); err != nil {
+		t.Fatalf("Failed to write plan: %s", err)
+	}
+	found, err := ReadPlan(path)
+	if err != nil {
+		t.Fatalf("Failed to read plan: %s", err)
+	}
+	if !reflect.DeepEqual(p, found) {
+		t.Errorf("Expected (%v), Found (%v)", p, found)
+	}
+
+	tests := []struct {
+		body, err string
+	}{
+		{`{"Version": 2, "StackName": "test-stack", "ChangeSetID": "testcs-id"}`, "Unsupported plan version 2"},
+		{`{"Version": 1, "StackName": "test-stack"}`, "Plan does not have a stack or a change set"},
+		{`Version: 1`, "Invalid plan"},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(path, []byte(test.body), 0644); err != nil {
+			t.Fatalf("Failed to write plan: %s", err)
+		}
+		if _, err := ReadPlan(path); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected (%s), Found (%v)", test.err, err)
+		}
+	}
+}
+
+func TestPlanParameters(t *testing.T) {
+	params := []*cf.Parameter{
+		{ParameterKey: aws.String("Env"), ParameterValue: aws.String("prod")},
+		{ParameterKey: aws.String("Password"), ParameterValue: aws.String("s3cr3t")},
+		{ParameterKey: aws.String("Port"), UsePreviousValue: aws.Bool(true)},
+	}
+	declared := []TemplateParameter{{Name: "Env"}, {Name: "Password", NoEcho: true}, {Name: "Port"}}
+
+	expected := []PlanParameter{
+		{Name: "Env", Value: "prod"},
+		{Name: "Password", Value: "****"},
+		{Name: "Port", UsePreviousValue: true},
+	}
+	if found := PlanParameters(params, declared); !reflect.DeepEqual(expected, found) {
+		t.Errorf("Expected (%v), Found (%v)", expected, found)
+	}
+}
+
+func TestPlanChanges(t *testing.T) {
+	var deployed = `
+	Resources:
+		Bucket:
+			Type: AWS::S3::Bucket
+			Properties:
+				BucketName: b1.isubuz.com
+				Tags: [{Key: env, Value: dev}]
+		Topic:
+			Type: AWS::SNS::Topic
+	`
+
+	var d = `
+	Resources:
+		Bucket:
+			Type: AWS::S3::Bucket
+			Properties:
+				BucketName: !Sub "b1.${AWS::Region}.isubuz.com"
+				AccessControl: Private
+				Tags: [{Key: env, Value: prod}]
+		Queue:
+			Type: AWS::SQS::Queue
+	`
+
+	tmpl := capabilitiesTemplate(t, d)
+	deployedTmpl := capabilitiesTemplate(t, deployed)
+
+	detail := func(attribute, name, recreation, source string) *cf.ResourceChangeDetail {
+		return &cf.ResourceChangeDetail{
+			ChangeSource: aws.String(source),
+			Evaluation:   aws.String(cf.EvaluationTypeStatic),
+			Target: &cf.ResourceTargetDefinition{
+				Attribute:          aws.String(attribute),
+				Name:               aws.String(name),
+				RequiresRecreation: aws.String(recreation),
+			},
+		}
+	}
+	cs := &cf.DescribeChangeSetOutput{Changes: []*cf.Change{
+		{ResourceChange: &cf.ResourceChange{
+			Action:             aws.String(cf.ChangeActionModify),
+			LogicalResourceId:  aws.String("Bucket"),
+			PhysicalResourceId: aws.String("b1.isubuz.com"),
+			ResourceType:       aws.String("AWS::S3::Bucket"),
+			Replacement:        aws.String(cf.ReplacementTrue),
+			Scope:              aws.StringSlice([]string{cf.ResourceAttributeProperties, cf.ResourceAttributeTags}),
+			Details: []*cf.ResourceChangeDetail{
+				detail(cf.ResourceAttributeProperties, "BucketName", cf.RequiresRecreationAlways, cf.ChangeSourceDirectModification),
+				detail(cf.ResourceAttributeProperties, "AccessControl", cf.RequiresRecreationNever, cf.ChangeSourceDirectModification),
+				detail(cf.ResourceAttributeTags, "", cf.RequiresRecreationNever, cf.ChangeSourceDirectModification),
+			},
+		}},
+		{ResourceChange: &cf.ResourceChange{
+			Action:            aws.String(cf.ChangeActionAdd),
+			LogicalResourceId: aws.String("Queue"),
+			ResourceType:      aws.String("AWS::SQS::Queue"),
+		}},
+		{ResourceChange: &cf.ResourceChange{
+			Action:            aws.String(cf.ChangeActionRemove),
+			LogicalResourceId: aws.String("Topic"),
+			ResourceType:      aws.String("AWS::SNS::Topic"),
+		}},
+	}}
+
+	changes := PlanChanges(cs, tmpl, deployedTmpl)
+	if len(changes) != 3 {
+		t.Fatalf("Expected (3) changes, Found (%d)", len(changes))
+	}
+
+	var found []string
+	for _, c := range changes {
+		found = append(found, fmt.Sprintf("%s %s %s %v", c.Action, c.LogicalResourceID, c.Source, c.Scope))
+		for _, d := range c.Details {
+			found = append(found, fmt.Sprintf("%s.%s %s: %s -> %s", d.Attribute, d.Name, d.RequiresRecreation, d.OldValue, d.NewValue))
+		}
+	}
+	expected := []string{
+		"Modify Bucket yaml-0:2 [Properties Tags]",
+		`Properties.BucketName Always: "b1.isubuz.com" -> {"Fn::Sub":"b1.${AWS::Region}.isubuz.com"}`,
+		`Properties.AccessControl Never:  -> "Private"`,
+		`Tags. Never: [{"Key":"env","Value":"dev"}] -> [{"Key":"env","Value":"prod"}]`,
+		"Add Queue yaml-0:8 []",
+		"Remove Topic  []",
+	}
+	if !reflect.DeepEqual(expected, found) {
+		t.Errorf("Expected (%s), Found (%s)", strings.Join(expected, "\n"), strings.Join(found, "\n"))
+	}
+}
+
+func TestPlanSummary(t *testing.T) {
+	tests := []struct {
+		summary  PlanSummary
+		expected string
+	}{
+		{PlanSummary{}, "0 to add, 0 to change, 0 to destroy"},
+		{PlanSummary{Add: 3, Modify: 2, Replace: 1, Remove: 1}, "3 to add, 2 to change (1 replacement), 1 to destroy"},
+		{PlanSummary{Modify: 2, Replace: 2}, "0 to add, 2 to change (2 replacements), 0 to destroy"},
+	}
+	for _, test := range tests {
+		if found := test.summary.String(); found != test.expected {
+			t.Errorf("Expected (%s), Found (%s)", test.expected, found)
+		}
+	}
+
+	// The resources of nested stacks are counted along with the nested stacks
+	p := &Plan{Changes: []PlanChange{
+		{Action: cf.ChangeActionAdd, LogicalResourceID: "Bucket"},
+		{Action: cf.ChangeActionModify, LogicalResourceID: "Network", NestedChanges: []PlanChange{
+			{Action: cf.ChangeActionAdd, LogicalResourceID: "Subnet"},
+			{Action: cf.ChangeActionModify, LogicalResourceID: "Vpc", Replacement: cf.ReplacementTrue},
+			{Action: cf.ChangeActionRemove, LogicalResourceID: "Gateway"},
+		}},
+	}}
+	expected := PlanSummary{Add: 2, Modify: 2, Remove: 1, Replace: 1}
+	if found := p.Summary(); found != expected {
+		t.Errorf("Expected (%v), Found (%v)", expected, found)
+	}
+}
+
+func TestHasNestedStacks(t *testing.T) {
+	tests := []struct {
+		template string
+		expected bool
+	}{
+		{"Resources:\n  Bucket:\n    Type: AWS::S3::Bucket\n", false},
+		{"Resources:\n  Network:\n    Type: AWS::CloudFormation::Stack\n", true},
+		{"Description: no resources\n", false},
+	}
+	for _, test := range tests {
+		tmpl := capabilitiesTemplate(t, test.template)
+		if found := tmpl.HasNestedStacks(); found != test.expected {
+			t.Errorf("Expected (%t), Found (%t) for (%s)", test.expected, found, test.template)
+		}
+
+		in := &StackInput{IncludeNestedStacks: tmpl.HasNestedStacks()}
+		input := (&StackConfig{StackName: "test-stack"}).CreateChangeSetInput("testcs", cf.ChangeSetTypeUpdate, in)
+		if aws.BoolValue(input.IncludeNestedStacks) != test.expected {
+			t.Errorf("Expected IncludeNestedStacks (%t), Found (%v)", test.expected, input.IncludeNestedStacks)
+		}
+	}
+}
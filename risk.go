@@ -0,0 +1,141 @@
+package cform
+
+import (
+	"fmt"
+	"strings"
+
+	cf "github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+// Risks of the changes to the resources of a stack which may lose data
+const (
+	// A stateful or protected resource is replaced and the old resource is
+	// deleted
+	RiskReplace = "Replace"
+	// A resource is removed and deleted or a protected resource is removed
+	RiskDestroy = "Destroy"
+)
+
+// statefulResourceTypes are the resource types which store data that is lost
+// when the resource is deleted, e.g. when it is replaced.
+var statefulResourceTypes = map[string]bool{
+	"AWS::Backup::BackupVault":           true,
+	"AWS::Cognito::UserPool":             true,
+	"AWS::DocDB::DBCluster":              true,
+	"AWS::DynamoDB::GlobalTable":         true,
+	"AWS::DynamoDB::Table":               true,
+	"AWS::EC2::Volume":                   true,
+	"AWS::EFS::FileSystem":               true,
+	"AWS::ElastiCache::CacheCluster":     true,
+	"AWS::ElastiCache::ReplicationGroup": true,
+	"AWS::Elasticsearch::Domain":         true,
+	"AWS::FSx::FileSystem":               true,
+	"AWS::KMS::Key":                      true,
+	"AWS::Kinesis::Stream":               true,
+	"AWS::Logs::LogGroup":                true,
+	"AWS::Neptune::DBCluster":            true,
+	"AWS::OpenSearchService::Domain":     true,
+	"AWS::RDS::DBCluster":                true,
+	"AWS::RDS::DBInstance":               true,
+	"AWS::Redshift::Cluster":             true,
+	"AWS::S3::Bucket":                    true,
+	"AWS::SQS::Queue":                    true,
+	"AWS::SecretsManager::Secret":        true,
+	"AWS::Timestream::Table":             true,
+}
+
+// IsStatefulResourceType checks if the resources of the type store data which
+// is lost when a resource is deleted.
+func IsStatefulResourceType(typ string) bool {
+	return statefulResourceTypes[typ]
+}
+
+// ClassifyRisks sets the risk of the changes which may lose data along with
+// the reason.
+//
+// A modified resource is at risk if it is, or may be, replaced and is either
+// of a stateful type or protected, unless its `UpdateReplacePolicy` in the new
+// template retains the old resource. A removed resource is at risk unless its
+// `DeletionPolicy` in the deployed template retains it. Protected resources
+// are always at risk when they are replaced or removed.
+func ClassifyRisks(changes []PlanChange, tmpl, deployed *Template, protected []string) {
+	for i := range changes {
+		c := &changes[i]
+		isProtected := indexOf(protected, c.LogicalResourceID) != -1
+
+		switch c.Action {
+		case cf.ChangeActionModify:
+			if c.Replacement != cf.ReplacementTrue && c.Replacement != cf.ReplacementConditional {
+				continue
+			}
+			replaced := "is replaced"
+			if c.Replacement == cf.ReplacementConditional {
+				replaced = "may be replaced"
+			}
+
+			switch policy := tmpl.resourceAttribute(c.LogicalResourceID, "UpdateReplacePolicy"); {
+			case isProtected:
+				c.Risk, c.RiskReason = RiskReplace, "protected resource "+replaced
+			case isRetained(policy):
+				continue
+			case IsStatefulResourceType(c.ResourceType):
+				c.Risk, c.RiskReason = RiskReplace, fmt.Sprintf("stateful resource %s without a retaining UpdateReplacePolicy", replaced)
+			}
+
+		case cf.ChangeActionRemove:
+			if isProtected {
+				c.Risk, c.RiskReason = RiskDestroy, "protected resource is removed"
+				continue
+			}
+			if deployed == nil {
+				c.Risk, c.RiskReason = RiskDestroy, "resource is removed and its DeletionPolicy is unknown"
+				continue
+			}
+			if !isRetained(deployed.resourceAttribute(c.LogicalResourceID, "DeletionPolicy")) {
+				c.Risk, c.RiskReason = RiskDestroy, "resource is removed without a retaining DeletionPolicy"
+			}
+		}
+	}
+}
+
+// isRetained checks if a deletion or an update replace policy retains the
+// data of a deleted resource.
+func isRetained(policy string) bool {
+	return policy == "Retain" || policy == "RetainExceptOnCreate" || policy == "Snapshot"
+}
+
+// RiskyChanges returns the changes of the plan, including the changes to its
+// nested stacks, which may lose data. The logical IDs of the resources of
+// nested stacks are qualified by the logical IDs of the nested stacks, e.g.
+// `Network/Vpc`.
+func (p *Plan) RiskyChanges() []PlanChange {
+	return riskyChanges(p.Changes, "")
+}
+
+// riskyChanges returns the changes which may lose data; the prefix qualifies
+// the logical IDs of the resources.
+func riskyChanges(changes []PlanChange, prefix string) []PlanChange {
+	var risky []PlanChange
+	for _, c := range changes {
+		if c.Risk != "" {
+			qualified := c
+			qualified.LogicalResourceID = prefix + c.LogicalResourceID
+			risky = append(risky, qualified)
+		}
+		risky = append(risky, riskyChanges(c.NestedChanges, prefix+c.LogicalResourceID+"/")...)
+	}
+	return risky
+}
+
+// NestedProtectedResources returns the protected resources of the nested
+// stack, i.e. the protected logical IDs qualified by the logical ID of the
+// nested stack without the qualifier.
+func NestedProtectedResources(protected []string, nestedStack string) []string {
+	var nested []string
+	for _, id := range protected {
+		if strings.HasPrefix(id, nestedStack+"/") {
+			nested = append(nested, strings.TrimPrefix(id, nestedStack+"/"))
+		}
+	}
+	return nested
+}
@@ -0,0 +1,110 @@
+package cform
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	cf "github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+func TestClassifyRisks(t *testing.T) {
+	var deployed = `
+	Resources:
+		Topic:
+			Type: AWS::SNS::Topic
+		Archive:
+			Type: AWS::S3::Bucket
+			DeletionPolicy: Retain
+		Logs:
+			Type: AWS::Logs::LogGroup
+	`
+
+	var d = `
+	Resources:
+		Database:
+			Type: AWS::RDS::DBInstance
+		Table:
+			Type: AWS::DynamoDB::Table
+			UpdateReplacePolicy: Snapshot
+		Function:
+			Type: AWS::Lambda::Function
+		Queue:
+			Type: AWS::SQS::Queue
+		Bucket:
+			Type: AWS::S3::Bucket
+	`
+
+	tmpl := capabilitiesTemplate(t, d)
+	deployedTmpl := capabilitiesTemplate(t, deployed)
+
+	changes := []PlanChange{
+		{Action: cf.ChangeActionModify, LogicalResourceID: "Database", ResourceType: "AWS::RDS::DBInstance", Replacement: cf.ReplacementTrue},
+		{Action: cf.ChangeActionModify, LogicalResourceID: "Table", ResourceType: "AWS::DynamoDB::Table", Replacement: cf.ReplacementTrue},
+		{Action: cf.ChangeActionModify, LogicalResourceID: "Function", ResourceType: "AWS::Lambda::Function", Replacement: cf.ReplacementTrue},
+		{Action: cf.ChangeActionModify, LogicalResourceID: "Queue", ResourceType: "AWS::SQS::Queue", Replacement: cf.ReplacementConditional},
+		{Action: cf.ChangeActionModify, LogicalResourceID: "Bucket", ResourceType: "AWS::S3::Bucket", Replacement: cf.ReplacementFalse},
+		{Action: cf.ChangeActionRemove, LogicalResourceID: "Topic", ResourceType: "AWS::SNS::Topic"},
+		{Action: cf.ChangeActionRemove, LogicalResourceID: "Archive", ResourceType: "AWS::S3::Bucket"},
+		{Action: cf.ChangeActionRemove, LogicalResourceID: "Logs", ResourceType: "AWS::Logs::LogGroup"},
+		{Action: cf.ChangeActionAdd, LogicalResourceID: "Function2", ResourceType: "AWS::Lambda::Function"},
+	}
+	ClassifyRisks(changes, tmpl, deployedTmpl, []string{"Function", "Archive"})
+
+	var found []string
+	for _, c := range changes {
+		found = append(found, fmt.Sprintf("%s %s: %s", c.LogicalResourceID, c.Risk, c.RiskReason))
+	}
+	expected := []string{
+		"Database Replace: stateful resource is replaced without a retaining UpdateReplacePolicy",
+		"Table : ",
+		"Function Replace: protected resource is replaced",
+		"Queue Replace: stateful resource may be replaced without a retaining UpdateReplacePolicy",
+		"Bucket : ",
+		"Topic Destroy: resource is removed without a retaining DeletionPolicy",
+		"Archive Destroy: protected resource is removed",
+		"Logs Destroy: resource is removed without a retaining DeletionPolicy",
+		"Function2 : ",
+	}
+	if !reflect.DeepEqual(expected, found) {
+		t.Errorf("Expected (%s), Found (%s)", strings.Join(expected, "\n"), strings.Join(found, "\n"))
+	}
+
+	p := &Plan{Changes: changes}
+	if risky := p.RiskyChanges(); len(risky) != 6 {
+		t.Errorf("Expected (6) risky changes, Found (%d)", len(risky))
+	}
+
+	// The risky changes of nested stacks are qualified by the nested stack
+	p = &Plan{Changes: []PlanChange{{
+		Action:            cf.ChangeActionModify,
+		LogicalResourceID: "Network",
+		NestedChanges: []PlanChange{{
+			Action:            cf.ChangeActionModify,
+			LogicalResourceID: "Storage",
+			NestedChanges:     []PlanChange{{LogicalResourceID: "Table", Risk: RiskReplace}},
+		}, {LogicalResourceID: "Vpc", Risk: RiskDestroy}},
+	}}}
+	found = nil
+	for _, c := range p.RiskyChanges() {
+		found = append(found, c.Risk+" "+c.LogicalResourceID)
+	}
+	expected = []string{"Replace Network/Storage/Table", "Destroy Network/Vpc"}
+	if !reflect.DeepEqual(expected, found) {
+		t.Errorf("Expected (%v), Found (%v)", expected, found)
+	}
+
+	protected := NestedProtectedResources([]string{"Database", "Network/Vpc", "Network/Storage/Table", "NetworkVpc"}, "Network")
+	if expected := []string{"Vpc", "Storage/Table"}; !reflect.DeepEqual(expected, protected) {
+		t.Errorf("Expected (%v), Found (%v)", expected, protected)
+	}
+
+	// The DeletionPolicy of removed resources is unknown without the deployed
+	// template
+	removed := []PlanChange{{Action: cf.ChangeActionRemove, LogicalResourceID: "Archive", ResourceType: "AWS::S3::Bucket"}}
+	ClassifyRisks(removed, tmpl, nil, nil)
+	if removed[0].Risk != RiskDestroy {
+		t.Errorf("Expected (%s), Found (%s)", RiskDestroy, removed[0].Risk)
+	}
+}
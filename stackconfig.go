@@ -0,0 +1,308 @@
+package cform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	cf "github.com/aws/aws-sdk-go/service/cloudformation"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// StackConfig is the configuration of a CloudFormation stack which is read
+// from a stack config file written in YAML or JSON. It contains the details
+// which are usually passed to the `cloudformation` CLI command.
+type StackConfig struct {
+	// Path of the base stack config which this config extends, relative to
+	// the directory of this config
+	Extends string `yaml:"Extends,omitempty"`
+	// Name of the stack
+	StackName string `yaml:"StackName,omitempty"`
+	// Values of the template parameters keyed by the parameter name
+	Parameters map[string]ParameterValue `yaml:"Parameters,omitempty"`
+	// Tags of the stack keyed by the tag name
+	Tags map[string]string `yaml:"Tags,omitempty"`
+	// Capabilities acknowledged for the stack, e.g. `CAPABILITY_IAM`; nil
+	// acknowledges the capabilities required by the template
+	Capabilities []string `yaml:"Capabilities,omitempty"`
+	// ARN of the IAM role which CloudFormation assumes to operate the stack
+	RoleARN string `yaml:"RoleARN,omitempty"`
+	// ARNs of the SNS topics to which the stack events are published
+	NotificationARNs []string `yaml:"NotificationARNs,omitempty"`
+	// Whether the stack can be deleted; nil leaves the setting unchanged
+	TerminationProtection *bool `yaml:"TerminationProtection,omitempty"`
+	// Stack policy document which is either a dictionary or a JSON string
+	StackPolicy interface{} `yaml:"StackPolicy,omitempty"`
+	// Deprecated: change sets do not support a creation timeout, hence
+	// ParseStackConfig rejects configs which set it
+	TimeoutInMinutes int64 `yaml:"TimeoutInMinutes,omitempty"`
+	// Alarms monitored during stack operations
+	RollbackConfiguration *RollbackConfiguration `yaml:"RollbackConfiguration,omitempty"`
+	// Logical IDs of the resources which are never replaced or removed
+	// without explicit approval
+	ProtectedResources []string `yaml:"ProtectedResources,omitempty"`
+}
+
+// RollbackConfiguration describes the alarms which roll back a stack
+// operation when they go to the ALARM state.
+type RollbackConfiguration struct {
+	MonitoringTimeInMinutes int64             `yaml:"MonitoringTimeInMinutes,omitempty"`
+	RollbackTriggers        []RollbackTrigger `yaml:"RollbackTriggers,omitempty"`
+}
+
+// RollbackTrigger is an alarm monitored during stack operations.
+type RollbackTrigger struct {
+	Arn  string `yaml:"Arn"`
+	Type string `yaml:"Type"`
+}
+
+// ReadStackConfig reads the stack config file along with the base configs
+// which it extends. The returned config is the effective config in which the
+// settings of a config override the settings of its base config.
+func ReadStackConfig(path string) (*StackConfig, error) {
+	return readStackConfig(path, nil)
+}
+
+// readStackConfig reads the stack config file; the extended paths are the
+// absolute paths of the configs which extend it and is used to detect cycles.
+func readStackConfig(path string, extended []string) (*StackConfig, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range extended {
+		if p == abs {
+			return nil, fmt.Errorf("%s: Stack config extends itself", path)
+		}
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := ParseStackConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	for k, v := range c.Parameters {
+		v.dir = filepath.Dir(path)
+		c.Parameters[k] = v
+	}
+	if c.Extends == "" {
+		return c, nil
+	}
+
+	basePath := c.Extends
+	if !filepath.IsAbs(basePath) {
+		basePath = filepath.Join(filepath.Dir(path), basePath)
+	}
+	base, err := readStackConfig(basePath, append(extended, abs))
+	if err != nil {
+		return nil, err
+	}
+	base.override(c)
+	return base, nil
+}
+
+// FindEnvStackConfig returns the path of the stack config of the environment
+// which is the file named after the environment, e.g. `prod.yml`, in the
+// directory.
+func FindEnvStackConfig(dir, env string) (string, error) {
+	if env == "" || strings.ContainsAny(env, `/\`) {
+		return "", fmt.Errorf("Invalid environment name %q", env)
+	}
+
+	for _, ext := range DefaultExtensions {
+		p := filepath.Join(dir, env+ext)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("No stack config found for environment %s in %s", env, dir)
+}
+
+// ParseStackConfig parses the YAML or JSON stack config. Unknown keys are
+// rejected so that misspelt keys do not go unnoticed.
+func ParseStackConfig(source []byte) (*StackConfig, error) {
+	c := &StackConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(source))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if c.TimeoutInMinutes != 0 {
+		return nil, fmt.Errorf("TimeoutInMinutes is not supported since stacks are created using change sets; remove it")
+	}
+	switch c.StackPolicy.(type) {
+	case nil, string, map[string]interface{}:
+	default:
+		return nil, fmt.Errorf("StackPolicy must be a dictionary or a JSON string")
+	}
+	return c, nil
+}
+
+// override overrides the settings of the config with the settings defined by
+// another config. Parameters and tags are overridden individually while every
+// other setting is replaced as a whole.
+func (c *StackConfig) override(other *StackConfig) {
+	c.Extends = ""
+	if other.StackName != "" {
+		c.StackName = other.StackName
+	}
+	c.Parameters = overrideParameters(c.Parameters, other.Parameters)
+	c.Tags = overrideMap(c.Tags, other.Tags)
+	if other.Capabilities != nil {
+		c.Capabilities = other.Capabilities
+	}
+	if other.RoleARN != "" {
+		c.RoleARN = other.RoleARN
+	}
+	if other.NotificationARNs != nil {
+		c.NotificationARNs = other.NotificationARNs
+	}
+	if other.TerminationProtection != nil {
+		c.TerminationProtection = other.TerminationProtection
+	}
+	if other.StackPolicy != nil {
+		c.StackPolicy = other.StackPolicy
+	}
+	if other.RollbackConfiguration != nil {
+		c.RollbackConfiguration = other.RollbackConfiguration
+	}
+	if other.ProtectedResources != nil {
+		c.ProtectedResources = other.ProtectedResources
+	}
+}
+
+// Marshal returns the YAML representation of the config.
+func (c *StackConfig) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// StackPolicyBody returns the JSON stack policy document or an empty string
+// if the config does not have a stack policy.
+func (c *StackConfig) StackPolicyBody() (string, error) {
+	switch p := c.StackPolicy.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return p, nil
+	}
+
+	b, err := json.Marshal(c.StackPolicy)
+	if err != nil {
+		return "", fmt.Errorf("Invalid StackPolicy: %s", err.Error())
+	}
+	return string(b), nil
+}
+
+// StackInput is the template body and the values resolved from the template
+// and the stack config which are passed to the stack operations.
+type StackInput struct {
+	TemplateBody string
+	Parameters   []*cf.Parameter
+	Capabilities []string
+	// Whether change sets are also created for the nested stacks of the
+	// template
+	IncludeNestedStacks bool
+}
+
+// CreateChangeSetInput returns the input to create a change set of the type,
+// `CREATE` for a new stack or `UPDATE` for an existing stack.
+func (c *StackConfig) CreateChangeSetInput(changeSetName, changeSetType string, in *StackInput) *cf.CreateChangeSetInput {
+	input := &cf.CreateChangeSetInput{
+		ChangeSetName:         aws.String(changeSetName),
+		ChangeSetType:         aws.String(changeSetType),
+		StackName:             aws.String(c.StackName),
+		TemplateBody:          aws.String(in.TemplateBody),
+		Parameters:            in.Parameters,
+		Tags:                  c.tags(),
+		Capabilities:          aws.StringSlice(in.Capabilities),
+		RoleARN:               optionalString(c.RoleARN),
+		NotificationARNs:      aws.StringSlice(c.NotificationARNs),
+		RollbackConfiguration: c.rollbackConfiguration(),
+	}
+	if in.IncludeNestedStacks {
+		input.IncludeNestedStacks = aws.Bool(true)
+	}
+	return input
+}
+
+// tags returns the stack tags sorted by their names.
+func (c *StackConfig) tags() []*cf.Tag {
+	var tags []*cf.Tag
+	for _, k := range sortedKeys(c.Tags) {
+		tags = append(tags, &cf.Tag{Key: aws.String(k), Value: aws.String(c.Tags[k])})
+	}
+	return tags
+}
+
+func (c *StackConfig) rollbackConfiguration() *cf.RollbackConfiguration {
+	if c.RollbackConfiguration == nil {
+		return nil
+	}
+
+	rc := &cf.RollbackConfiguration{}
+	if c.RollbackConfiguration.MonitoringTimeInMinutes > 0 {
+		rc.MonitoringTimeInMinutes = aws.Int64(c.RollbackConfiguration.MonitoringTimeInMinutes)
+	}
+	for _, t := range c.RollbackConfiguration.RollbackTriggers {
+		rc.RollbackTriggers = append(rc.RollbackTriggers, &cf.RollbackTrigger{
+			Arn:  aws.String(t.Arn),
+			Type: aws.String(t.Type),
+		})
+	}
+	return rc
+}
+
+// overrideMap returns the entries of the map overridden by the entries of
+// another map.
+func overrideMap(m, other map[string]string) map[string]string {
+	if len(other) == 0 {
+		return m
+	}
+
+	merged := make(map[string]string)
+	for k, v := range m {
+		merged[k] = v
+	}
+	for k, v := range other {
+		merged[k] = v
+	}
+	return merged
+}
+
+// optionalString returns a pointer to the string or nil if it is empty.
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,222 @@
+package cform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	cf "github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+func TestParseStackConfig(t *testing.T) {
+	var yamlConfig = format(`
+	StackName: web
+	Parameters:
+		InstanceType: t3.micro
+		Port: 8080
+	Tags:
+		Team: platform
+		CostCenter: "0123"
+	Capabilities: [CAPABILITY_IAM]
+	RoleARN: arn:aws:iam::123456789012:role/cfn
+	NotificationARNs: [arn:aws:sns:eu-west-1:123456789012:events]
+	TerminationProtection: true
+	StackPolicy:
+		Statement:
+			- {Effect: Allow, Action: "Update:*", Principal: "*", Resource: "*"}
+	RollbackConfiguration:
+		MonitoringTimeInMinutes: 10
+		RollbackTriggers:
+			- {Arn: "arn:aws:cloudwatch:eu-west-1:123456789012:alarm:errors", Type: "AWS::CloudWatch::Alarm"}
+	`)
+
+	var jsonConfig = `{
+		"StackName": "web",
+		"Parameters": {"InstanceType": "t3.micro", "Port": "8080"},
+		"Tags": {"Team": "platform", "CostCenter": "0123"},
+		"Capabilities": ["CAPABILITY_IAM"],
+		"RoleARN": "arn:aws:iam::123456789012:role/cfn",
+		"NotificationARNs": ["arn:aws:sns:eu-west-1:123456789012:events"],
+		"TerminationProtection": true,
+		"StackPolicy": {"Statement": [{"Effect": "Allow", "Action": "Update:*", "Principal": "*", "Resource": "*"}]},
+		"RollbackConfiguration": {
+			"MonitoringTimeInMinutes": 10,
+			"RollbackTriggers": [{"Arn": "arn:aws:cloudwatch:eu-west-1:123456789012:alarm:errors", "Type": "AWS::CloudWatch::Alarm"}]
+		}
+	}`
+
+	expected := &cf.CreateChangeSetInput{
+		ChangeSetName: aws.String("testcs"),
+		ChangeSetType: aws.String(cf.ChangeSetTypeCreate),
+		StackName:     aws.String("web"),
+		TemplateBody:  aws.String("body"),
+		Parameters: []*cf.Parameter{
+			{ParameterKey: aws.String("InstanceType"), ParameterValue: aws.String("t3.micro")},
+			{ParameterKey: aws.String("Port"), ParameterValue: aws.String("8080")},
+		},
+		Tags: []*cf.Tag{
+			{Key: aws.String("CostCenter"), Value: aws.String("0123")},
+			{Key: aws.String("Team"), Value: aws.String("platform")},
+		},
+		Capabilities:     aws.StringSlice([]string{"CAPABILITY_IAM"}),
+		RoleARN:          aws.String("arn:aws:iam::123456789012:role/cfn"),
+		NotificationARNs: aws.StringSlice([]string{"arn:aws:sns:eu-west-1:123456789012:events"}),
+		RollbackConfiguration: &cf.RollbackConfiguration{
+			MonitoringTimeInMinutes: aws.Int64(10),
+			RollbackTriggers: []*cf.RollbackTrigger{{
+				Arn:  aws.String("arn:aws:cloudwatch:eu-west-1:123456789012:alarm:errors"),
+				Type: aws.String("AWS::CloudWatch::Alarm"),
+			}},
+		},
+	}
+
+	for _, s := range []string{yamlConfig, jsonConfig} {
+		c, err := ParseStackConfig([]byte(s))
+		if err != nil {
+			t.Errorf("Failed to parse stack config: %s", err)
+			continue
+		}
+
+		params, err := c.ResolveParameters([]TemplateParameter{{Name: "InstanceType"}, {Name: "Port"}})
+		if err != nil {
+			t.Errorf("Failed to resolve parameters: %s", err)
+			continue
+		}
+
+		input := c.CreateChangeSetInput("testcs", cf.ChangeSetTypeCreate, &StackInput{TemplateBody: "body", Parameters: params, Capabilities: c.Capabilities})
+		if !reflect.DeepEqual(expected, input) {
+			t.Errorf("Expected (%v), Found (%v)", expected, input)
+		}
+
+		policy, err := c.StackPolicyBody()
+		expectedPolicy := `{"Statement":[{"Action":"Update:*","Effect":"Allow","Principal":"*","Resource":"*"}]}`
+		if err != nil || policy != expectedPolicy {
+			t.Errorf("Expected (%s), Found (%s) (%v)", expectedPolicy, policy, err)
+		}
+		if c.TerminationProtection == nil || !*c.TerminationProtection {
+			t.Errorf("Expected termination protection, Found (%v)", c.TerminationProtection)
+		}
+	}
+}
+
+func TestParseStackConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"Capability: [CAPABILITY_IAM]": "field Capability not found",
+		"TimeoutInMinutes: 30":         "TimeoutInMinutes is not supported",
+		"StackPolicy: [Allow]":         "StackPolicy must be a dictionary or a JSON string",
+	}
+
+	for s, expected := range tests {
+		_, err := ParseStackConfig([]byte(s))
+		if err == nil {
+			t.Errorf("Expected error for %s", s)
+			continue
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected (%s), Found (%s)", expected, err)
+		}
+	}
+}
+
+func TestEmptyStackConfig(t *testing.T) {
+	c, err := ParseStackConfig([]byte("# No settings\n"))
+	if err != nil {
+		t.Errorf("Failed to parse stack config: %s", err)
+		return
+	}
+
+	c.StackName = "web"
+	input := c.CreateChangeSetInput("testcs", cf.ChangeSetTypeUpdate, &StackInput{TemplateBody: "body"})
+	if input.RoleARN != nil || input.RollbackConfiguration != nil || len(input.Parameters) != 0 || len(input.Tags) != 0 {
+		t.Errorf("Unexpected stack settings: %v", input)
+	}
+	if policy, err := c.StackPolicyBody(); err != nil || policy != "" {
+		t.Errorf("Unexpected stack policy (%s) (%v)", policy, err)
+	}
+}
+
+func TestReadStackConfigExtends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cform")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"base.yml": format(`
+		StackName: web
+		Parameters:
+			InstanceType: t3.micro
+			Env: dev
+		Tags:
+			Team: platform
+		Capabilities: [CAPABILITY_IAM]
+		ProtectedResources: [Database]
+		`),
+		"environments/prod.yml": format(`
+		Extends: ../base.yml
+		StackName: web-prod
+		Parameters:
+			Env: prod
+		Tags:
+			Env: prod
+		TerminationProtection: true
+		`),
+		"environments/loop.json": `{"Extends": "loop.json"}`,
+	}
+	for name, body := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %s", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(body), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err)
+		}
+	}
+
+	p, err := FindEnvStackConfig(filepath.Join(dir, "environments"), "prod")
+	if err != nil {
+		t.Errorf("Failed to find stack config: %s", err)
+		return
+	}
+
+	c, err := ReadStackConfig(p)
+	if err != nil {
+		t.Errorf("Failed to read stack config: %s", err)
+		return
+	}
+
+	b, err := c.Marshal()
+	if err != nil {
+		t.Errorf("Failed to marshal stack config: %s", err)
+		return
+	}
+
+	var expected = format(`
+	StackName: web-prod
+	Parameters:
+		Env: prod
+		InstanceType: t3.micro
+	Tags:
+		Env: prod
+		Team: platform
+	Capabilities:
+		- CAPABILITY_IAM
+	TerminationProtection: true
+	ProtectedResources:
+		- Database
+	`)
+	testResult(t, expected, string(b))
+
+	if _, err := ReadStackConfig(filepath.Join(dir, "environments", "loop.json")); err == nil || !strings.Contains(err.Error(), "extends itself") {
+		t.Errorf("Expected error for cyclic stack configs, Found (%v)", err)
+	}
+
+	if _, err := FindEnvStackConfig(filepath.Join(dir, "environments"), "staging"); err == nil {
+		t.Errorf("Expected error for missing environment")
+	}
+}
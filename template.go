@@ -1,54 +1,155 @@
 package cform
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path"
 	"path/filepath"
-	"regexp"
+	"reflect"
+	"sort"
 	"strings"
 
-	yaml "gopkg.in/yaml.v2"
+	yaml "gopkg.in/yaml.v3"
 )
 
 // TemplateReader defines the operations performed by the reader which reads
-// one or more YAML file contents.
+// one or more template sources.
 type TemplateReader interface {
-	Next() ([]byte, error)
+	Next() (*TemplateSource, error)
 	HasNext() bool
 }
 
-// TemplateMap is a representation of the YAML struct returned after reading
-// contents from the YAML file.
-type TemplateMap map[string]map[string]interface{}
+// TemplateSource is a template source returned by a `TemplateReader`.
+type TemplateSource struct {
+	// Name of the source, e.g. the file name, which is used to report the
+	// location of the template elements
+	Name string
+	Body []byte
+}
+
+// SourceLocation is the location of a template element in a template source.
+type SourceLocation struct {
+	Name string
+	Line int
+}
+
+func (l SourceLocation) String() string {
+	return fmt.Sprintf("%s:%d", l.Name, l.Line)
+}
+
+// SourceMap maps the elements of a merged template to their location in the
+// template sources. The keys are the names of the sections, e.g. `Description`,
+// and the entries of dictionary sections qualified by the section name, e.g.
+// `Resources.Bucket`.
+type SourceMap map[string]SourceLocation
+
+// Entry returns the location of the entry of a dictionary section.
+func (m SourceMap) Entry(section, key string) (SourceLocation, bool) {
+	l, ok := m[section+"."+key]
+	return l, ok
+}
+
+// DefaultExtensions are the extensions of the files read by the
+// `DirectoryReader` unless other extensions are configured.
+var DefaultExtensions = []string{".yml", ".yaml", ".json"}
+
+// DirectoryReaderOptions defines which files are read by the
+// `DirectoryReader`.
+//
+// The include and exclude patterns are matched against the path of each file
+// relative to the source directory using forward slashes, e.g.
+// `network/vpc.yml`. A pattern without any slash is matched against the file
+// name only. Patterns support the syntax of `path.Match` along with `**` which
+// matches any number of directories, e.g. `network/**/*.yml`.
+type DirectoryReaderOptions struct {
+	// Files matching any of these patterns are read. All files are read if
+	// no patterns are specified.
+	Include []string
+
+	// Files and directories matching any of these patterns are skipped.
+	Exclude []string
+
+	// Extensions of the files which are read. Defaults to
+	// `DefaultExtensions` if empty.
+	Extensions []string
+}
 
-// DirectoryReader implements the `TemplateReader` interface to read yaml files
-// from an input source directory.
+// DirectoryReader implements the `TemplateReader` interface to read template
+// files from an input source directory and its sub directories.
+//
+// The files are read in the lexical order of their paths. Hidden files and
+// directories i.e. those whose name starts with a dot are skipped.
 type DirectoryReader struct {
 	SourceDir string
 	fileNames []string
 	idx       int
 }
 
-func NewDirectoryReader(sourceDir string) (*DirectoryReader, error) {
+func NewDirectoryReader(sourceDir string, opts DirectoryReaderOptions) (*DirectoryReader, error) {
 	r := &DirectoryReader{SourceDir: sourceDir}
-	files, err := ioutil.ReadDir(sourceDir)
-	if err != nil {
-		return r, err
+
+	for _, p := range append(opts.Include, opts.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return r, fmt.Errorf("Invalid pattern %s: %s", p, err.Error())
+		}
 	}
 
-	for _, f := range files {
-		r.fileNames = append(r.fileNames, filepath.Join(sourceDir, f.Name()))
+	extensions := opts.Extensions
+	if len(extensions) == 0 {
+		extensions = DefaultExtensions
+	}
+
+	walkFn := func(fileName string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileName == sourceDir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(sourceDir, fileName)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if strings.HasPrefix(info.Name(), ".") || matchAnyGlob(opts.Exclude, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		if indexOf(extensions, strings.ToLower(filepath.Ext(fileName))) < 0 {
+			return nil
+		}
+		if len(opts.Include) > 0 && !matchAnyGlob(opts.Include, rel) {
+			return nil
+		}
+
+		r.fileNames = append(r.fileNames, fileName)
+		return nil
+	}
+
+	if err := filepath.Walk(sourceDir, walkFn); err != nil {
+		return r, err
 	}
 	r.idx = -1
 	return r, nil
 }
 
-func (r *DirectoryReader) Next() ([]byte, error) {
+func (r *DirectoryReader) Next() (*TemplateSource, error) {
 	source, err := ioutil.ReadFile(r.fileNames[r.idx])
 	if err != nil {
 		return nil, err
 	}
-	return source, nil
+	return &TemplateSource{Name: r.fileNames[r.idx], Body: source}, nil
 }
 
 func (r *DirectoryReader) HasNext() bool {
@@ -56,8 +157,58 @@ func (r *DirectoryReader) HasNext() bool {
 	return r.idx < len(r.fileNames)
 }
 
-func MergeTemplates(reader TemplateReader) ([]byte, error) {
-	mergedMap := make(TemplateMap)
+// MergeOptions defines how the merged template is written.
+type MergeOptions struct {
+	// Format of the merged template
+	Format Format
+
+	// Form in which the intrinsic functions are written. JSON templates
+	// always use the long form.
+	IntrinsicForm IntrinsicForm
+
+	// If true, an entry in a dictionary section like a resource or a
+	// parameter can be overridden by a later source which defines an entry
+	// with the same name. Otherwise such duplicates fail the merge.
+	AllowOverride bool
+
+	// Called for every entry overridden when `AllowOverride` is true
+	OnOverride func(Override)
+
+	// If true, the location of each resource in the template sources is
+	// added to the `cform:Source` key of the resource metadata
+	AnnotateSources bool
+}
+
+// Override describes an entry of a template section which has been replaced
+// by an entry with the same name from a later source.
+type Override struct {
+	Section string
+	Key     string
+	// Location of the entry which was overridden
+	Source SourceLocation
+	// Location of the entry which replaced the overridden one
+	OverriddenBy SourceLocation
+}
+
+// MergeTemplates reads all the template sources from the reader and returns
+// them merged into a single template along with the location of the merged
+// template elements in the sources.
+func MergeTemplates(reader TemplateReader, opts MergeOptions) ([]byte, SourceMap, error) {
+	t, err := ReadTemplates(reader, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := t.Marshal(opts.Format, opts.IntrinsicForm)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, t.Sources(), nil
+}
+
+// ReadTemplates reads all the template sources from the reader and merges
+// them into a new template.
+func ReadTemplates(reader TemplateReader, opts MergeOptions) (*Template, error) {
+	t := NewTemplate(opts)
 
 	for reader.HasNext() {
 		source, err := reader.Next()
@@ -65,66 +216,552 @@ func MergeTemplates(reader TemplateReader) ([]byte, error) {
 			return nil, err
 		}
 
-		if err := validateYaml(source); err != nil {
+		if err := t.Add(source.Name, source.Body); err != nil {
 			return nil, err
 		}
+	}
+	return t, nil
+}
 
-		m, err := unmarshalCfnYaml(source)
-		if err != nil {
-			return nil, err
+// Template is the merged representation of one or more CloudFormation template
+// sources.
+//
+// Top-level sections whose value is a dictionary, like `Resources`, are merged
+// entry by entry. Sections with a scalar or list value, like `Description`,
+// can be defined by more than one source only if all of them define the same
+// value. The `Transform` section is the exception; the macros declared by each
+// source are combined in the order in which they are first declared.
+//
+// An entry of a dictionary section can be defined by only one source unless
+// overrides are allowed in the merge options.
+type Template struct {
+	opts     MergeOptions
+	sections map[string]*templateSection
+}
+
+// sectionOrder is the conventional order of the top-level sections of a
+// CloudFormation template. Any other sections are written after these in
+// alphabetical order.
+var sectionOrder = []string{
+	"AWSTemplateFormatVersion",
+	"Description",
+	"Metadata",
+	"Parameters",
+	"Rules",
+	"Mappings",
+	"Conditions",
+	"Transform",
+	"Resources",
+	"Outputs",
+}
+
+// templateSection is a top-level section of the template.
+type templateSection struct {
+	// Location of the section in the source which first defined it
+	source SourceLocation
+	// Name of the section with the comments of all the sources attached to it
+	key *yaml.Node
+	// Value of a section which is a scalar or a list; nil for a dictionary
+	value *yaml.Node
+	// Entries of a section which is a dictionary; nil for a scalar or a list
+	entries map[string]*templateEntry
+	// Names of the entries in the order in which they were first defined
+	keys []string
+	// Whether any source declared the `Transform` section as a list
+	transformList bool
+}
+
+// templateEntry is an entry of a dictionary section, e.g. a resource.
+type templateEntry struct {
+	key   *yaml.Node
+	value *yaml.Node
+	// Location of the entry in the source which defined it
+	source SourceLocation
+}
+
+// NewTemplate returns an empty template to which sources are added using the
+// input merge options.
+func NewTemplate(opts MergeOptions) *Template {
+	return &Template{opts: opts, sections: make(map[string]*templateSection)}
+}
+
+// Add merges the contents of the named template source, which is either a YAML
+// or a JSON document, into the template.
+func (t *Template) Add(name string, source []byte) error {
+	var root *yaml.Node
+	var err error
+	if isJSON(source) {
+		root, err = unmarshalCfnJSON(source)
+	} else {
+		root, err = unmarshalCfnYaml(source)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err.Error())
+	}
+	if root == nil {
+		// Empty document
+		return nil
+	}
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: Template must be a dictionary", name)
+	}
+
+	location := func(n *yaml.Node) SourceLocation {
+		return SourceLocation{Name: name, Line: n.Line}
+	}
+
+	for i := 0; i < len(root.Content); i += 2 {
+		k, v := root.Content[i].Value, root.Content[i+1]
+		if v.ShortTag() == "!!null" {
+			// Sections without any value, e.g. `Parameters:` with all the
+			// parameters commented out
+			continue
+		}
+		// A dictionary Transform is reported as invalid by addTransform
+		isMap := v.Kind == yaml.MappingNode && k != "Transform"
+
+		s, ok := t.sections[k]
+		if !ok {
+			s = &templateSection{source: location(root.Content[i]), key: root.Content[i]}
+			if isMap {
+				s.entries = make(map[string]*templateEntry)
+			}
+			t.sections[k] = s
+		} else {
+			mergeComments(s.key, root.Content[i])
+		}
+
+		if isMap != (s.entries != nil) {
+			return fmt.Errorf("Section %s is a dictionary in one of %s and %s but not in the other", k, s.source, location(root.Content[i]))
 		}
 
-		for k, v := range m {
-			if val, ok := mergedMap[k]; ok {
-				for kk, vv := range v {
-					val[kk] = vv
+		switch {
+		case isMap:
+			for j := 0; j < len(v.Content); j += 2 {
+				key := v.Content[j]
+				if e, ok := s.entries[key.Value]; ok {
+					if err := t.checkOverride(k, key.Value, e.source, location(key)); err != nil {
+						return err
+					}
+				} else {
+					s.keys = append(s.keys, key.Value)
 				}
-			} else {
-				mergedMap[k] = v
+				s.entries[key.Value] = &templateEntry{key: key, value: v.Content[j+1], source: location(key)}
+			}
+		case k == "Transform":
+			if err := s.addTransform(location(root.Content[i]), v); err != nil {
+				return err
 			}
+		case !ok:
+			s.value = v
+		case !sameValue(s.value, v):
+			return fmt.Errorf("Conflicting values for section %s in %s and %s", k, s.source, location(root.Content[i]))
 		}
 	}
+	return nil
+}
 
-	d, err := marshalCfnYaml(mergedMap)
+// checkOverride checks if the entry of a section defined by a source can be
+// overridden by another source.
+func (t *Template) checkOverride(section, key string, source, overriddenBy SourceLocation) error {
+	if !t.opts.AllowOverride {
+		return fmt.Errorf("Duplicate entry %s in section %s defined in %s and %s", key, section, source, overriddenBy)
+	}
+	if t.opts.OnOverride != nil {
+		t.opts.OnOverride(Override{Section: section, Key: key, Source: source, OverriddenBy: overriddenBy})
+	}
+	return nil
+}
+
+// addTransform adds the macros declared in the `Transform` section of a
+// source which can be either a single macro name or a list of macros.
+func (s *templateSection) addTransform(source SourceLocation, v *yaml.Node) error {
+	var macros []*yaml.Node
+	switch v.Kind {
+	case yaml.ScalarNode:
+		macros = []*yaml.Node{v}
+	case yaml.SequenceNode:
+		macros = v.Content
+		s.transformList = true
+	default:
+		return fmt.Errorf("Section Transform in %s must be a string or a list", source)
+	}
+
+	if s.value == nil {
+		s.value = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	}
+	for _, m := range macros {
+		found := false
+		for _, e := range s.value.Content {
+			if sameValue(e, m) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s.value.Content = append(s.value.Content, m)
+		}
+	}
+	return nil
+}
+
+// Sources returns the location of the template sections and the entries of
+// the dictionary sections in the template sources.
+func (t *Template) Sources() SourceMap {
+	m := make(SourceMap)
+	for k, s := range t.sections {
+		m[k] = s.source
+		for kk, e := range s.entries {
+			m[k+"."+kk] = e.source
+		}
+	}
+	return m
+}
+
+// sectionNames returns the names of the template sections in the order in
+// which they are written.
+func (t *Template) sectionNames() []string {
+	var names, others []string
+	for _, k := range sectionOrder {
+		if _, ok := t.sections[k]; ok {
+			names = append(names, k)
+		}
+	}
+	for k := range t.sections {
+		if indexOf(sectionOrder, k) < 0 {
+			others = append(others, k)
+		}
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+// Marshal returns the representation of the template in the input format with
+// intrinsic functions written in the input form.
+//
+// The sections are written in their conventional order and the entries of
+// each section in the order in which they were first defined.
+func (t *Template) Marshal(format Format, form IntrinsicForm) ([]byte, error) {
+	if format == JSON {
+		return t.marshalJSON()
+	}
+	return t.marshalYaml(form)
+}
+
+// marshalJSON returns the JSON representation of the template.
+func (t *Template) marshalJSON() ([]byte, error) {
+	return marshalCfnJSON(t.root())
+}
+
+// marshalYaml returns the YAML representation of the template.
+func (t *Template) marshalYaml(form IntrinsicForm) ([]byte, error) {
+	return marshalCfnYaml(t.root(), form)
+}
+
+// root returns a copy of the merged template as the root node of a document.
+func (t *Template) root() *yaml.Node {
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, k := range t.sectionNames() {
+		s := t.sections[k]
+
+		var v *yaml.Node
+		switch {
+		case s.entries != nil:
+			v = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			for _, kk := range s.keys {
+				e := s.entries[kk]
+				value := copyNode(e.value)
+				if k == "Resources" && t.opts.AnnotateSources {
+					annotateSource(value, e.source)
+				}
+				v.Content = append(v.Content, copyNode(e.key), value)
+			}
+		case k == "Transform" && !s.transformList && len(s.value.Content) == 1:
+			v = copyNode(s.value.Content[0])
+		default:
+			v = copyNode(s.value)
+		}
+
+		root.Content = append(root.Content, copyNode(s.key), v)
+	}
+	return root
+}
+
+// annotateSource adds the source location of the resource to the
+// `cform:Source` key of its metadata.
+func annotateSource(resource *yaml.Node, source SourceLocation) {
+	if resource.Kind != yaml.MappingNode {
+		return
+	}
+
+	var metadata *yaml.Node
+	for i := 0; i < len(resource.Content); i += 2 {
+		if resource.Content[i].Value == "Metadata" {
+			metadata = resource.Content[i+1]
+		}
+	}
+	if metadata == nil {
+		metadata = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		resource.Content = append(resource.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "Metadata"}, metadata)
+	}
+	if metadata.Kind != yaml.MappingNode {
+		return
+	}
+
+	metadata.Content = append(metadata.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "cform:Source"},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: source.String()})
+}
+
+// Checksum returns the hex encoded SHA-256 checksum of a template body.
+func Checksum(body []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(body))
+}
+
+// unmarshalCfnYaml returns the root node of the YAML template source with any
+// short form intrinsic functions rewritten to their long form. It returns nil
+// for an empty document.
+//
+// The nodes retain the style in which the values are written, e.g. quoted
+// strings like "0123" remain quoted strings and block scalars remain block
+// scalars, so that the values do not change when the template is written.
+// Aliases and merge keys are expanded since the anchors they refer to are
+// local to the source.
+func unmarshalCfnYaml(source []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(source, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 {
+		return nil, nil
+	}
+
+	root, err := expandAliases(doc.Content[0], nil)
 	if err != nil {
 		return nil, err
 	}
+	if err := expandShortForm(root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
 
-	return d, nil
+// expandAliases returns a copy of the node tree in which the aliases, e.g.
+// `*name`, are replaced by copies of the nodes with the anchors they refer to
+// and the merge keys (`<<`) of the dictionaries are replaced by the entries
+// they merge. The anchors are removed.
+//
+// The sections of the merged template are written in canonical order and may
+// come from different sources, hence an alias could otherwise be written
+// before its anchor or refer to a same-named anchor of another source.
+func expandAliases(n *yaml.Node, expanding []*yaml.Node) (*yaml.Node, error) {
+	if n.Kind == yaml.AliasNode {
+		for _, a := range expanding {
+			if a == n.Alias {
+				return nil, fmt.Errorf("Anchor %s at line %d contains an alias to itself", a.Anchor, a.Line)
+			}
+		}
+		c, err := expandAliases(n.Alias, expanding)
+		if err != nil {
+			return nil, err
+		}
+		c.HeadComment, c.LineComment, c.FootComment = n.HeadComment, n.LineComment, n.FootComment
+		return c, nil
+	}
+
+	if n.Anchor != "" {
+		expanding = append(expanding, n)
+	}
+	c := *n
+	c.Anchor = ""
+	c.Content = make([]*yaml.Node, len(n.Content))
+	for i, cc := range n.Content {
+		var err error
+		if c.Content[i], err = expandAliases(cc, expanding); err != nil {
+			return nil, err
+		}
+	}
+	if c.Kind == yaml.MappingNode {
+		if err := expandMergeKeys(&c); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
 }
 
-func validateYaml(yaml []byte) error {
-	// Check if the yaml contains any shortcode intrinsic functions
-	r, err := regexp.Compile(`(!(?:Base64|FindInMap|GetAtt|GetAZs|ImportValue|Join|Select|Split|Sub|Ref))`)
-	if err != nil {
-		return err
+// expandMergeKeys replaces the merge keys (`<<`) of the dictionary by the
+// entries of the dictionaries they merge which the dictionary does not define
+// itself. The entries of the earlier dictionaries of a merge key with a list
+// of dictionaries take precedence.
+func expandMergeKeys(n *yaml.Node) error {
+	var content, merged []*yaml.Node
+	for i := 0; i < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		if k.Kind != yaml.ScalarNode || k.ShortTag() != "!!merge" {
+			content = append(content, k, v)
+			continue
+		}
+
+		maps := []*yaml.Node{v}
+		if v.Kind == yaml.SequenceNode {
+			maps = v.Content
+		}
+		for _, m := range maps {
+			if m.Kind != yaml.MappingNode {
+				return fmt.Errorf("Merge key at line %d must refer to a dictionary or a list of dictionaries", k.Line)
+			}
+			merged = append(merged, m.Content...)
+		}
 	}
-	matches := r.FindAllString(string(yaml), -1)
-	if len(matches) > 0 {
-		return fmt.Errorf("Found shortcode intrinsic functions: %s; Use the Fn form instead", strings.Join(matches, ","))
+
+	for i := 0; i < len(merged); i += 2 {
+		defined := false
+		for j := 0; j < len(content); j += 2 {
+			if content[j].Value == merged[i].Value {
+				defined = true
+				break
+			}
+		}
+		if !defined {
+			content = append(content, merged[i], merged[i+1])
+		}
 	}
+	n.Content = content
 	return nil
 }
 
-func unmarshalCfnYaml(source []byte) (TemplateMap, error) {
-	// Escape quotes so that it can be unescaped later to make it appear later
-	// in the final generated yaml
-	str := strings.Replace(string(source), "\"", "\\\"", -1)
+// marshalCfnYaml returns the YAML representation of the node tree. Scalars are
+// written in the style they were read in, which the encoder falls back from
+// only when a value cannot be represented in that style.
+func marshalCfnYaml(root *yaml.Node, form IntrinsicForm) ([]byte, error) {
+	toBlockStyle(root)
+	if form == ShortForm {
+		contractToShortForm(root)
+	}
 
-	var m = make(TemplateMap)
-	if err := yaml.Unmarshal([]byte(str), &m); err != nil {
-		return m, err
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return nil, err
 	}
-	return m, nil
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-func marshalCfnYaml(m TemplateMap) ([]byte, error) {
-	d, err := yaml.Marshal(m)
-	if err != nil {
-		return nil, err
+// sameValue checks if two nodes represent the same value irrespective of how
+// the value is written, e.g. `[a, b]` and `- a\n- b`.
+func sameValue(a, b *yaml.Node) bool {
+	var va, vb interface{}
+	if err := a.Decode(&va); err != nil {
+		return false
+	}
+	if err := b.Decode(&vb); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// copyNode returns a deep copy of the node so that the copy can be modified
+// without modifying the template.
+func copyNode(n *yaml.Node) *yaml.Node {
+	c := *n
+	c.Content = make([]*yaml.Node, len(n.Content))
+	for i, cc := range n.Content {
+		c.Content[i] = copyNode(cc)
+	}
+	return &c
+}
+
+// mergeComments adds the comments of the node from another source to the
+// comments of the node.
+func mergeComments(n, other *yaml.Node) {
+	n.HeadComment = joinComments(n.HeadComment, other.HeadComment)
+	n.LineComment = joinComments(n.LineComment, other.LineComment)
+	n.FootComment = joinComments(n.FootComment, other.FootComment)
+}
+
+// joinComments returns the lines of both the comments, skipping the second
+// comment if it is already present in the first.
+func joinComments(a, b string) string {
+	switch {
+	case b == "" || strings.Contains(a, b):
+		return a
+	case a == "":
+		return b
 	}
+	return a + "\n" + b
+}
 
-	// Unescape quotes which were escaped during unmarshalling
-	str := strings.Replace(string(d), "\\\"", "\"", -1)
-	return []byte(str), nil
+// toBlockStyle rewrites all the flow style lists and dictionaries in the node
+// tree to block style, e.g. `[a, b]` becomes `- a\n- b`.
+//
+// The line comment of a dictionary value like `Foo: [a, b] # Comment` is moved
+// to its key since it cannot follow a list or a dictionary written in block
+// style.
+func toBlockStyle(n *yaml.Node) {
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if (v.Kind == yaml.MappingNode || v.Kind == yaml.SequenceNode) && v.LineComment != "" {
+				k.LineComment = joinComments(k.LineComment, v.LineComment)
+				v.LineComment = ""
+			}
+		}
+	}
+
+	n.Style &^= yaml.FlowStyle
+	for _, c := range n.Content {
+		toBlockStyle(c)
+	}
+}
+
+// matchAnyGlob checks if the slash separated path matches any of the glob
+// patterns described in `DirectoryReaderOptions`.
+func matchAnyGlob(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if !strings.Contains(p, "/") {
+			if ok, _ := path.Match(p, path.Base(name)); ok {
+				return true
+			}
+		} else if matchGlobSegments(strings.Split(p, "/"), strings.Split(name, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlobSegments matches the path segments against the pattern segments
+// where a `**` pattern segment matches zero or more path segments.
+func matchGlobSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlobSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
 }
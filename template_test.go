@@ -1,8 +1,19 @@
 package cform
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"testing/quick"
+
+	yaml "gopkg.in/yaml.v3"
 )
 
 type inMemoryReader struct {
@@ -21,8 +32,8 @@ func newInMemoryReader(yamls []string) (*inMemoryReader, error) {
 	return r, nil
 }
 
-func (r *inMemoryReader) Next() ([]byte, error) {
-	return r.yamls[r.idx], nil
+func (r *inMemoryReader) Next() (*TemplateSource, error) {
+	return &TemplateSource{Name: fmt.Sprintf("yaml-%d", r.idx), Body: r.yamls[r.idx]}, nil
 }
 
 func (r *inMemoryReader) HasNext() bool {
@@ -59,13 +70,13 @@ func TestSingleYamlMerge(t *testing.T) {
 	`)
 	r, err := newInMemoryReader([]string{d})
 	if err != nil {
-		t.Errorf("Failed to create reader", err)
+		t.Errorf("Failed to create reader: %s", err)
 		return
 	}
 
-	b, err := MergeTemplates(r)
+	b, _, err := MergeTemplates(r, MergeOptions{})
 	if err != nil {
-		t.Errorf("Failed to merge yaml", err)
+		t.Errorf("Failed to merge yaml: %s", err)
 		return
 	}
 
@@ -106,13 +117,13 @@ func TestYamlMergeWithOverlap(t *testing.T) {
 
 	r, err := newInMemoryReader([]string{d1, d2})
 	if err != nil {
-		t.Errorf("Failed to create reader", err)
+		t.Errorf("Failed to create reader: %s", err)
 		return
 	}
 
-	b, err := MergeTemplates(r)
+	b, _, err := MergeTemplates(r, MergeOptions{})
 	if err != nil {
-		t.Errorf("Failed to merge yaml", err)
+		t.Errorf("Failed to merge yaml: %s", err)
 		return
 	}
 
@@ -151,13 +162,13 @@ func TestYamlMergeWithNoOverlap(t *testing.T) {
 
 	r, err := newInMemoryReader([]string{d1, d2})
 	if err != nil {
-		t.Errorf("Failed to create reader", err)
+		t.Errorf("Failed to create reader: %s", err)
 		return
 	}
 
-	b, err := MergeTemplates(r)
+	b, _, err := MergeTemplates(r, MergeOptions{})
 	if err != nil {
-		t.Errorf("Failed to merge yaml", err)
+		t.Errorf("Failed to merge yaml: %s", err)
 		return
 	}
 
@@ -202,13 +213,13 @@ func TestYamlMergeWithStrings(t *testing.T) {
 
 	r, err := newInMemoryReader([]string{d1, d2})
 	if err != nil {
-		t.Errorf("Failed to create reader", err)
+		t.Errorf("Failed to create reader: %s", err)
 		return
 	}
 
-	b, err := MergeTemplates(r)
+	b, _, err := MergeTemplates(r, MergeOptions{})
 	if err != nil {
-		t.Errorf("Failed to merge yaml", err)
+		t.Errorf("Failed to merge yaml: %s", err)
 		return
 	}
 
@@ -256,15 +267,1073 @@ func TestYamlMergeWithMultiLineStrings(t *testing.T) {
 
 	r, err := newInMemoryReader([]string{d1, d2})
 	if err != nil {
-		t.Errorf("Failed to create reader", err)
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	b, _, err := MergeTemplates(r, MergeOptions{})
+	if err != nil {
+		t.Errorf("Failed to merge yaml: %s", err)
+		return
+	}
+
+	testResult(t, d, string(b))
+}
+
+func TestYamlMergeWithShortForm(t *testing.T) {
+	var d1 = format(`
+	Resources:
+		Bucket:
+			Properties:
+				BucketName: !Sub "${AWS::StackName}-bucket"
+				Tags:
+					- Key: Zone
+					  Value: !Select [0, !GetAZs ""]
+	`)
+
+	var d2 = format(`
+	Outputs:
+		BucketArn:
+			Value: !GetAtt Bucket.Arn
+		BucketName:
+			Condition: IsProd
+			Value: !If [IsProd, !Ref Bucket, !Ref "AWS::NoValue"]
+	`)
+
+	var d = format(`
+	Resources:
+		Bucket:
+			Properties:
+				BucketName:
+					Fn::Sub: "${AWS::StackName}-bucket"
+				Tags:
+					- Key: Zone
+					  Value:
+						Fn::Select:
+							- 0
+							- Fn::GetAZs: ""
+	Outputs:
+		BucketArn:
+			Value:
+				Fn::GetAtt:
+					- Bucket
+					- Arn
+		BucketName:
+			Condition: IsProd
+			Value:
+				Fn::If:
+					- IsProd
+					- Ref: Bucket
+					- Ref: "AWS::NoValue"
+	`)
+
+	r, err := newInMemoryReader([]string{d1, d2})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	b, _, err := MergeTemplates(r, MergeOptions{})
+	if err != nil {
+		t.Errorf("Failed to merge yaml: %s", err)
+		return
+	}
+
+	testResult(t, d, string(b))
+}
+
+func TestYamlMergeToShortForm(t *testing.T) {
+	var d1 = format(`
+	Resources:
+		Instance:
+			Properties:
+				ImageId:
+					Fn::FindInMap: [Images, !Ref "AWS::Region", Ami]
+				UserData:
+					Fn::Base64: !Sub |
+						#!/bin/bash -xe
+						/opt/aws/bin/cfn-init --stack ${AWS::StackName}
+	`)
+
+	var d2 = format(`
+	Conditions:
+		IsProd:
+			Fn::And:
+				- Fn::Equals: [!Ref Env, prod]
+				- Fn::Not: [!Condition IsTest]
+	Outputs:
+		Ip:
+			Value:
+				Fn::GetAtt: [Instance, PublicIp]
+	`)
+
+	var d = format(`
+	Conditions:
+		IsProd: !And
+			- !Equals
+				- !Ref Env
+				- prod
+			- !Not
+				- !Condition IsTest
+	Resources:
+		Instance:
+			Properties:
+				ImageId: !FindInMap
+					- Images
+					- !Ref "AWS::Region"
+					- Ami
+				UserData:
+					Fn::Base64: !Sub |
+						#!/bin/bash -xe
+						/opt/aws/bin/cfn-init --stack ${AWS::StackName}
+	Outputs:
+		Ip:
+			Value: !GetAtt Instance.PublicIp
+	`)
+
+	r, err := newInMemoryReader([]string{d1, d2})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	b, _, err := MergeTemplates(r, MergeOptions{IntrinsicForm: ShortForm})
+	if err != nil {
+		t.Errorf("Failed to merge yaml: %s", err)
+		return
+	}
+
+	testResult(t, d, string(b))
+}
+
+func TestYamlMergeWithComments(t *testing.T) {
+	var d1 = format(`
+	# Network resources
+	Resources: # See TICKET-1
+		# Chosen to avoid overlapping with the office network
+		Vpc:
+			Type: AWS::EC2::VPC
+			Properties:
+				CidrBlock: !Ref VpcCidr # From the parameters
+	Outputs:
+		VpcCidr:
+			Value: !GetAtt [Vpc, CidrBlock] # Primary CIDR block
+	`)
+
+	var d2 = format(`
+	# IAM resources
+	Resources:
+		Role:
+			Type: AWS::IAM::Role
+			Properties:
+				ManagedPolicyArns:
+					# TICKET-2: Allow reading the artifacts
+					- arn:aws:iam::aws:policy/ReadOnlyAccess # Read only
+	`)
+
+	var long = format(`
+	# Network resources
+	# IAM resources
+	Resources: # See TICKET-1
+		# Chosen to avoid overlapping with the office network
+		Vpc:
+			Type: AWS::EC2::VPC
+			Properties:
+				CidrBlock:
+					Ref: VpcCidr # From the parameters
+		Role:
+			Type: AWS::IAM::Role
+			Properties:
+				ManagedPolicyArns:
+					# TICKET-2: Allow reading the artifacts
+					- arn:aws:iam::aws:policy/ReadOnlyAccess # Read only
+	Outputs:
+		VpcCidr:
+			Value:
+				Fn::GetAtt: # Primary CIDR block
+					- Vpc
+					- CidrBlock
+	`)
+
+	var short = format(`
+	# Network resources
+	# IAM resources
+	Resources: # See TICKET-1
+		# Chosen to avoid overlapping with the office network
+		Vpc:
+			Type: AWS::EC2::VPC
+			Properties:
+				CidrBlock: !Ref VpcCidr # From the parameters
+		Role:
+			Type: AWS::IAM::Role
+			Properties:
+				ManagedPolicyArns:
+					# TICKET-2: Allow reading the artifacts
+					- arn:aws:iam::aws:policy/ReadOnlyAccess # Read only
+	Outputs:
+		VpcCidr:
+			Value: !GetAtt Vpc.CidrBlock # Primary CIDR block
+	`)
+
+	for form, d := range map[IntrinsicForm]string{LongForm: long, ShortForm: short} {
+		r, err := newInMemoryReader([]string{d1, d2})
+		if err != nil {
+			t.Errorf("Failed to create reader: %s", err)
+			return
+		}
+
+		b, _, err := MergeTemplates(r, MergeOptions{IntrinsicForm: form})
+		if err != nil {
+			t.Errorf("Failed to merge yaml: %s", err)
+			return
+		}
+
+		testResult(t, d, string(b))
+	}
+}
+
+func TestYamlMergeWithUnknownTag(t *testing.T) {
+	var d1 = format(`
+	Resources:
+		Bucket:
+			Properties:
+				BucketName: !Foo bar
+	`)
+
+	r, err := newInMemoryReader([]string{d1})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	if _, _, err := MergeTemplates(r, MergeOptions{}); err == nil {
+		t.Errorf("Expected error for unknown tag")
+	}
+}
+
+func TestYamlMergeWithScalarSections(t *testing.T) {
+	var d1 = format(`
+	AWSTemplateFormatVersion: "2010-09-09"
+	Description: Test stack
+	Transform: AWS::Serverless-2016-10-31
+	Resources:
+		r1: 1
+	`)
+
+	var d2 = format(`
+	AWSTemplateFormatVersion: "2010-09-09"
+	Transform: [AWS::Serverless-2016-10-31, AWS::Include]
+	Resources:
+		r2: 2
+	`)
+
+	var d = format(`
+	AWSTemplateFormatVersion: "2010-09-09"
+	Description: Test stack
+	Transform:
+		- AWS::Serverless-2016-10-31
+		- AWS::Include
+	Resources:
+		r1: 1
+		r2: 2
+	`)
+
+	r, err := newInMemoryReader([]string{d1, d2})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	b, _, err := MergeTemplates(r, MergeOptions{})
+	if err != nil {
+		t.Errorf("Failed to merge yaml: %s", err)
+		return
+	}
+
+	testResult(t, d, string(b))
+}
+
+func TestYamlMergeWithDictionaryTransform(t *testing.T) {
+	var d1 = format(`
+	Transform:
+		Name: AWS::Include
+		Parameters:
+			Location: s3://bucket/snippet.yml
+	Resources:
+		r1: 1
+	`)
+
+	r, err := newInMemoryReader([]string{d1})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	expErr := "Section Transform in yaml-0:1 must be a string or a list"
+	_, _, err = MergeTemplates(r, MergeOptions{})
+	if err == nil || err.Error() != expErr {
+		t.Errorf("Expected (%s), Found (%v)", expErr, err)
+	}
+}
+
+func TestYamlMergeWithConflictingScalarSections(t *testing.T) {
+	var d1 = format(`
+	Description: Stack one
+	`)
+
+	var d2 = format(`
+	Description: Stack two
+	`)
+
+	r, err := newInMemoryReader([]string{d1, d2})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	expErr := "Conflicting values for section Description in yaml-0:1 and yaml-1:1"
+	_, _, err = MergeTemplates(r, MergeOptions{})
+	if err == nil || err.Error() != expErr {
+		t.Errorf("Expected (%s), Found (%v)", expErr, err)
+	}
+}
+
+func TestYamlMergeWithMismatchedSections(t *testing.T) {
+	var d1 = format(`
+	Resources:
+		r1: 1
+	`)
+
+	var d2 = format(`
+	Resources: none
+	`)
+
+	r, err := newInMemoryReader([]string{d1, d2})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	expErr := "Section Resources is a dictionary in one of yaml-0:1 and yaml-1:1 but not in the other"
+	_, _, err = MergeTemplates(r, MergeOptions{})
+	if err == nil || err.Error() != expErr {
+		t.Errorf("Expected (%s), Found (%v)", expErr, err)
+	}
+}
+
+func TestYamlMergeWithDuplicateEntries(t *testing.T) {
+	var d1 = format(`
+	Resources:
+		Bucket: 1
+	`)
+
+	var d2 = format(`
+	Resources:
+		Bucket: 2
+	`)
+
+	r, err := newInMemoryReader([]string{d1, d2})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	expErr := "Duplicate entry Bucket in section Resources defined in yaml-0:2 and yaml-1:2"
+	_, _, err = MergeTemplates(r, MergeOptions{})
+	if err == nil || err.Error() != expErr {
+		t.Errorf("Expected (%s), Found (%v)", expErr, err)
+	}
+}
+
+func TestYamlMergeWithOverrides(t *testing.T) {
+	var d1 = format(`
+	Parameters:
+		p1: 1
+	Resources:
+		Bucket: 1
+	`)
+
+	var d2 = format(`
+	Resources:
+		Bucket: 2
+	`)
+
+	var d3 = format(`
+	Parameters:
+		p1: 3
+	Resources:
+		Bucket: 3
+	`)
+
+	var d = format(`
+	Parameters:
+		p1: 3
+	Resources:
+		Bucket: 3
+	`)
+
+	r, err := newInMemoryReader([]string{d1, d2, d3})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	var overrides []Override
+	opts := MergeOptions{
+		AllowOverride: true,
+		OnOverride: func(o Override) {
+			overrides = append(overrides, o)
+		},
+	}
+	b, _, err := MergeTemplates(r, opts)
+	if err != nil {
+		t.Errorf("Failed to merge yaml: %s", err)
+		return
+	}
+
+	testResult(t, d, string(b))
+
+	// Sections of a source are merged in no particular order
+	expOverrides := map[Override]bool{
+		{Section: "Resources", Key: "Bucket", Source: SourceLocation{"yaml-0", 4}, OverriddenBy: SourceLocation{"yaml-1", 2}}: true,
+		{Section: "Resources", Key: "Bucket", Source: SourceLocation{"yaml-1", 2}, OverriddenBy: SourceLocation{"yaml-2", 4}}: true,
+		{Section: "Parameters", Key: "p1", Source: SourceLocation{"yaml-0", 2}, OverriddenBy: SourceLocation{"yaml-2", 2}}:    true,
+	}
+	if len(overrides) != len(expOverrides) {
+		t.Errorf("Expected %d overrides, Found %v", len(expOverrides), overrides)
+	}
+	for _, o := range overrides {
+		if !expOverrides[o] {
+			t.Errorf("Unexpected override %v", o)
+		}
+	}
+}
+
+func TestYamlMergeWithCanonicalOrder(t *testing.T) {
+	var d1 = format(`
+	Outputs:
+		o1: 1
+	Resources:
+		Queue:
+			Type: AWS::SQS::Queue
+			Properties:
+				QueueName: q
+				DelaySeconds: 1
+	Description: Test stack
+	`)
+
+	var d2 = format(`
+	Resources:
+		Bucket:
+			Type: AWS::S3::Bucket
+	Parameters:
+		p1: 1
+	AWSTemplateFormatVersion: "2010-09-09"
+	`)
+
+	var d = format(`
+	AWSTemplateFormatVersion: "2010-09-09"
+	Description: Test stack
+	Parameters:
+		p1: 1
+	Resources:
+		Queue:
+			Type: AWS::SQS::Queue
+			Properties:
+				QueueName: q
+				DelaySeconds: 1
+		Bucket:
+			Type: AWS::S3::Bucket
+	Outputs:
+		o1: 1
+	`)
+
+	r, err := newInMemoryReader([]string{d1, d2})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	b, _, err := MergeTemplates(r, MergeOptions{})
+	if err != nil {
+		t.Errorf("Failed to merge yaml: %s", err)
+		return
+	}
+
+	testResult(t, d, string(b))
+}
+
+func TestYamlMergeWithAnchors(t *testing.T) {
+	// The anchor of the alias in Resources is defined in Outputs, which is
+	// written after Resources
+	var d1 = format(`
+	Outputs:
+		BucketName:
+			Value: &name
+				Fn::Sub: "${AWS::StackName}-bucket"
+	Resources:
+		Bucket:
+			Type: AWS::S3::Bucket
+			Properties:
+				BucketName: *name
+	`)
+
+	// The anchor has the same name as the anchor of the other source
+	var d2 = format(`
+	Resources:
+		Queue:
+			Type: AWS::SQS::Queue
+			Properties: &queue
+				QueueName: &name q
+				DelaySeconds: 1
+		DeadLetterQueue:
+			Type: AWS::SQS::Queue
+			Properties:
+				<<: *queue
+				QueueName: dlq
+	Outputs:
+		QueueName:
+			Value: *name
+	`)
+
+	var d = format(`
+	Resources:
+		Bucket:
+			Type: AWS::S3::Bucket
+			Properties:
+				BucketName:
+					Fn::Sub: "${AWS::StackName}-bucket"
+		Queue:
+			Type: AWS::SQS::Queue
+			Properties:
+				QueueName: q
+				DelaySeconds: 1
+		DeadLetterQueue:
+			Type: AWS::SQS::Queue
+			Properties:
+				QueueName: dlq
+				DelaySeconds: 1
+	Outputs:
+		BucketName:
+			Value:
+				Fn::Sub: "${AWS::StackName}-bucket"
+		QueueName:
+			Value: q
+	`)
+
+	r, err := newInMemoryReader([]string{d1, d2})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	b, _, err := MergeTemplates(r, MergeOptions{})
+	if err != nil {
+		t.Errorf("Failed to merge yaml: %s", err)
+		return
+	}
+
+	testResult(t, d, string(b))
+
+	// The merged template must be valid on its own
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		t.Errorf("Failed to parse merged yaml: %s", err)
+	}
+}
+
+func TestYamlMergeWithInvalidAnchors(t *testing.T) {
+	tests := []string{
+		"Resources:\n  Bucket: &bucket\n    Properties: *bucket\n",
+		"Resources:\n  Bucket:\n    Properties:\n      <<: bucket\n",
+	}
+
+	for _, d := range tests {
+		if err := NewTemplate(MergeOptions{}).Add("test.yml", []byte(d)); err == nil {
+			t.Errorf("Expected error for %q", d)
+		}
+	}
+}
+
+func TestDirectoryReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cform")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"README.md",
+		"main.yml",
+		".main.yml.swp",
+		"compute/ec2.yaml",
+		"compute/legacy/ec2.yml",
+		"data/rds.json",
+		"data/rds_test.yml",
+		"network/vpc.yml",
+		"network/subnets/private.yml",
+		".git/config.yml",
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %s", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(""), 0644); err != nil {
+			t.Fatalf("Failed to create file: %s", err)
+		}
+	}
+
+	tests := []struct {
+		opts     DirectoryReaderOptions
+		expected []string
+	}{
+		{
+			DirectoryReaderOptions{},
+			[]string{"compute/ec2.yaml", "compute/legacy/ec2.yml", "data/rds.json", "data/rds_test.yml", "main.yml", "network/subnets/private.yml", "network/vpc.yml"},
+		},
+		{
+			DirectoryReaderOptions{Exclude: []string{"legacy", "*_test.yml"}},
+			[]string{"compute/ec2.yaml", "data/rds.json", "main.yml", "network/subnets/private.yml", "network/vpc.yml"},
+		},
+		{
+			DirectoryReaderOptions{Include: []string{"network/**"}},
+			[]string{"network/subnets/private.yml", "network/vpc.yml"},
+		},
+		{
+			DirectoryReaderOptions{Include: []string{"**/ec2.*"}, Exclude: []string{"compute/legacy/**"}},
+			[]string{"compute/ec2.yaml"},
+		},
+		{
+			DirectoryReaderOptions{Extensions: []string{".json", ".md"}},
+			[]string{"README.md", "data/rds.json"},
+		},
+	}
+
+	for _, test := range tests {
+		r, err := NewDirectoryReader(dir, test.opts)
+		if err != nil {
+			t.Errorf("Failed to create reader: %s", err)
+			continue
+		}
+
+		var names []string
+		for r.HasNext() {
+			source, err := r.Next()
+			if err != nil {
+				t.Errorf("Failed to read source: %s", err)
+				break
+			}
+			rel, _ := filepath.Rel(dir, source.Name)
+			names = append(names, filepath.ToSlash(rel))
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("Expected %v, Found %v", test.expected, names)
+		}
+	}
+}
+
+func TestJSONAndYamlMerge(t *testing.T) {
+	var d1 = `{
+  "AWSTemplateFormatVersion": "2010-09-09",
+  "Resources": {
+    "Bucket": {
+      "Type": "AWS::S3::Bucket",
+      "Properties": {
+        "BucketName": {"Fn::Sub": "${AWS::StackName}-bucket"},
+        "VersioningConfiguration": {"Status": "Enabled"}
+      }
+    }
+  }
+}`
+
+	var d2 = format(`
+	Resources:
+		Queue:
+			Type: AWS::SQS::Queue
+			Properties:
+				DelaySeconds: 5
+				QueueName: !Sub "${AWS::StackName}-queue"
+	`)
+
+	var d = format(`
+	AWSTemplateFormatVersion: "2010-09-09"
+	Resources:
+		Bucket:
+			Type: AWS::S3::Bucket
+			Properties:
+				BucketName:
+					Fn::Sub: ${AWS::StackName}-bucket
+				VersioningConfiguration:
+					Status: Enabled
+		Queue:
+			Type: AWS::SQS::Queue
+			Properties:
+				DelaySeconds: 5
+				QueueName:
+					Fn::Sub: "${AWS::StackName}-queue"
+	`)
+
+	r, err := newInMemoryReader([]string{d1, d2})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	b, _, err := MergeTemplates(r, MergeOptions{})
+	if err != nil {
+		t.Errorf("Failed to merge yaml: %s", err)
+		return
+	}
+
+	testResult(t, d, string(b))
+}
+
+func TestYamlMergeToJSON(t *testing.T) {
+	var d1 = format(`
+	Description: "Stack with <tags> & \"quotes\""
+	Resources:
+		Queue:
+			Type: AWS::SQS::Queue
+			Properties:
+				DelaySeconds: 5
+				FifoQueue: true
+				QueueName: !Sub "${AWS::StackName}-queue"
+				Tags: []
+	`)
+
+	var d = `{
+  "Description": "Stack with <tags> & \"quotes\"",
+  "Resources": {
+    "Queue": {
+      "Type": "AWS::SQS::Queue",
+      "Properties": {
+        "DelaySeconds": 5,
+        "FifoQueue": true,
+        "QueueName": {
+          "Fn::Sub": "${AWS::StackName}-queue"
+        },
+        "Tags": []
+      }
+    }
+  }
+}
+`
+
+	r, err := newInMemoryReader([]string{d1})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	b, _, err := MergeTemplates(r, MergeOptions{Format: JSON, IntrinsicForm: ShortForm})
+	if err != nil {
+		t.Errorf("Failed to merge yaml: %s", err)
+		return
+	}
+
+	if string(b) != d {
+		t.Errorf("Expected %s, Found %s", d, string(b))
+	}
+}
+
+func TestYamlMergeToJSONScalars(t *testing.T) {
+	var d1 = format(`
+	AWSTemplateFormatVersion: 2010-09-09
+	Resources:
+		Queue:
+			Type: AWS::SQS::Queue
+			Properties:
+				DelaySeconds: 0123
+				MaximumMessageSize: 0x1F
+				MessageRetentionPeriod: 1e3
+				ReceiveMessageWaitTimeSeconds: +1
+				FifoQueue: True
+				ContentBasedDeduplication: false
+				KmsMasterKeyId: ~
+				RedrivePolicy:
+	`)
+
+	var d = `{
+  "AWSTemplateFormatVersion": "2010-09-09",
+  "Resources": {
+    "Queue": {
+      "Type": "AWS::SQS::Queue",
+      "Properties": {
+        "DelaySeconds": "0123",
+        "MaximumMessageSize": "0x1F",
+        "MessageRetentionPeriod": 1e3,
+        "ReceiveMessageWaitTimeSeconds": "+1",
+        "FifoQueue": "True",
+        "ContentBasedDeduplication": false,
+        "KmsMasterKeyId": null,
+        "RedrivePolicy": null
+      }
+    }
+  }
+}
+`
+
+	r, err := newInMemoryReader([]string{d1})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
+		return
+	}
+
+	b, _, err := MergeTemplates(r, MergeOptions{Format: JSON})
+	if err != nil {
+		t.Errorf("Failed to merge yaml: %s", err)
+		return
+	}
+
+	if string(b) != d {
+		t.Errorf("Expected %s, Found %s", d, string(b))
+	}
+}
+
+func TestYamlMergeSources(t *testing.T) {
+	var d1 = format(`
+	Description: Test stack
+	Resources:
+		Bucket:
+			Type: AWS::S3::Bucket
+	`)
+
+	var d2 = `{
+  "Resources": {
+    "Queue": {
+      "Type": "AWS::SQS::Queue",
+      "Metadata": {"Owner": "team"}
+    }
+  }
+}`
+
+	var d = format(`
+	Description: Test stack
+	Resources:
+		Bucket:
+			Type: AWS::S3::Bucket
+			Metadata:
+				cform:Source: yaml-0:3
+		Queue:
+			Type: AWS::SQS::Queue
+			Metadata:
+				Owner: team
+				cform:Source: yaml-1:3
+	`)
+
+	r, err := newInMemoryReader([]string{d1, d2})
+	if err != nil {
+		t.Errorf("Failed to create reader: %s", err)
 		return
 	}
 
-	b, err := MergeTemplates(r)
+	b, sources, err := MergeTemplates(r, MergeOptions{AnnotateSources: true})
 	if err != nil {
-		t.Errorf("Failed to merge yaml", err)
+		t.Errorf("Failed to merge yaml: %s", err)
 		return
 	}
 
 	testResult(t, d, string(b))
+
+	expSources := SourceMap{
+		"Description":      {"yaml-0", 1},
+		"Resources":        {"yaml-0", 2},
+		"Resources.Bucket": {"yaml-0", 3},
+		"Resources.Queue":  {"yaml-1", 3},
+	}
+	if !reflect.DeepEqual(sources, expSources) {
+		t.Errorf("Expected %v, Found %v", expSources, sources)
+	}
+}
+
+// parseTemplate returns the template body as a generic value with short form
+// intrinsic functions rewritten to their long form so that templates can be
+// compared semantically.
+func parseTemplate(body []byte) (interface{}, *yaml.Node, error) {
+	var root *yaml.Node
+	var err error
+	if isJSON(body) {
+		root, err = unmarshalCfnJSON(body)
+	} else {
+		root, err = unmarshalCfnYaml(body)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var v interface{}
+	if err := root.Decode(&v); err != nil {
+		return nil, nil, err
+	}
+	return v, root, nil
+}
+
+// blockScalars returns the sorted values of all literal and folded scalars in
+// the node tree.
+func blockScalars(n *yaml.Node) []string {
+	var values []string
+	if n.Kind == yaml.ScalarNode && n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		values = append(values, n.Value)
+	}
+	for _, c := range n.Content {
+		values = append(values, blockScalars(c)...)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// jsonScalars sets the tag of the scalars which are written as JSON strings,
+// i.e. timestamps and numbers or booleans which are not valid JSON, to string.
+func jsonScalars(n *yaml.Node) {
+	if n.Kind == yaml.ScalarNode {
+		switch n.ShortTag() {
+		case "!!null", "!!str":
+		case "!!int", "!!float", "!!bool":
+			if !json.Valid([]byte(n.Value)) {
+				n.Tag = "!!str"
+			}
+		default:
+			n.Tag = "!!str"
+		}
+	}
+	for _, c := range n.Content {
+		jsonScalars(c)
+	}
+}
+
+// roundTrip merges the template body on its own and checks that the merged
+// template is semantically equal to it. Scalars which JSON cannot represent
+// as YAML reads them, e.g. `2010-09-09` or `0123`, are expected as strings
+// when the template is merged as JSON.
+func roundTrip(body []byte, opts MergeOptions) error {
+	_, expectedRoot, err := parseTemplate(body)
+	if err != nil {
+		return fmt.Errorf("Failed to parse template: %s", err)
+	}
+	if opts.Format == JSON {
+		jsonScalars(expectedRoot)
+	}
+	var expected interface{}
+	if err := expectedRoot.Decode(&expected); err != nil {
+		return fmt.Errorf("Failed to decode template: %s", err)
+	}
+
+	r := &inMemoryReader{yamls: [][]byte{body}, idx: -1}
+	b, _, err := MergeTemplates(r, opts)
+	if err != nil {
+		return fmt.Errorf("Failed to merge template: %s", err)
+	}
+
+	actual, actualRoot, err := parseTemplate(b)
+	if err != nil {
+		return fmt.Errorf("Failed to parse merged template: %s\n%s", err, b)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		return fmt.Errorf("Expected (%v), Found (%v)", expected, actual)
+	}
+
+	if opts.Format == YAML {
+		e, a := blockScalars(expectedRoot), blockScalars(actualRoot)
+		if !reflect.DeepEqual(e, a) {
+			return fmt.Errorf("Expected block scalars (%q), Found (%q)", e, a)
+		}
+	}
+	return nil
+}
+
+var roundTripOptions = []MergeOptions{
+	{Format: YAML, IntrinsicForm: LongForm},
+	{Format: YAML, IntrinsicForm: ShortForm},
+	{Format: JSON},
+}
+
+func TestRoundTripCorpus(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "roundtrip", "*"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("Failed to find round trip templates: %v", err)
+	}
+
+	for _, f := range files {
+		body, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %s", f, err)
+		}
+		for _, opts := range roundTripOptions {
+			if err := roundTrip(body, opts); err != nil {
+				t.Errorf("%s (format %d, form %d): %s", f, opts.Format, opts.IntrinsicForm, err)
+			}
+		}
+	}
+}
+
+// cfnString is a string made of characters which need quoting or escaping in
+// YAML or JSON, e.g. quotes, backslashes and values which look like numbers.
+type cfnString string
+
+var cfnStringParts = []string{
+	`"`, `'`, `\`, `\"`, `\\`, `\d{1,3}`, `: `, ` #`, "\n", "\t", " ", "-", "!",
+	"&", "*", "{", "}", "[", "]", ",", "%", "@", "`", "|", ">", "$", "${AWS::Region}",
+	"0", "0123", "1.10", "0x1F", "1e3", "true", "no", "null", "~", "foo", "é", "<br>",
+}
+
+func (cfnString) Generate(r *rand.Rand, size int) reflect.Value {
+	var b strings.Builder
+	for i := r.Intn(size + 1); i > 0; i-- {
+		b.WriteString(cfnStringParts[r.Intn(len(cfnStringParts))])
+	}
+	return reflect.ValueOf(cfnString(b.String()))
+}
+
+func TestRoundTripStrings(t *testing.T) {
+	for _, opts := range roundTripOptions {
+		opts := opts
+		f := func(value, sub, literal cfnString) bool {
+			// Write the strings using each of the YAML scalar styles
+			body := format(fmt.Sprintf(`
+			Resources:
+				Foo:
+					Type: AWS::Foo
+					Properties:
+						Plain: %s
+						Sub: !Sub %s
+						Literal: |-
+							%s
+			`, yamlQuote(string(value)), yamlQuote(string(sub)), blockLines(string(literal))))
+
+			if _, _, err := parseTemplate([]byte(body)); err != nil {
+				// Not every generated literal is a valid block scalar
+				return true
+			}
+			if err := roundTrip([]byte(body), opts); err != nil {
+				t.Log(err)
+				return false
+			}
+			return true
+		}
+		if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+			t.Errorf("Format %d, form %d: %s", opts.Format, opts.IntrinsicForm, err)
+		}
+	}
+}
+
+// blockLines returns the value as the indented lines of the literal block
+// scalar in TestRoundTripStrings. YAML cannot write tabs or trailing spaces in
+// block scalars and hence these are removed.
+func blockLines(s string) string {
+	lines := strings.Split("x"+strings.Replace(s, "\t", "", -1), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], " ")
+	}
+	return strings.Join(lines, "\n\t\t\t\t\t\t\t")
+}
+
+// yamlQuote returns the value as a double quoted YAML string.
+func yamlQuote(s string) string {
+	n := yaml.Node{Kind: yaml.ScalarNode, Style: yaml.DoubleQuotedStyle, Value: s}
+	b, err := yaml.Marshal(&n)
+	if err != nil {
+		panic(err)
+	}
+	return strings.TrimSuffix(string(b), "\n")
 }